@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// allPagesLimit is the number of titles on each page of Special:AllPages and
+// Special:PrefixIndex.
+const allPagesLimit = 200
+
+// pageBefore returns the first title of the page of up to limit titles in
+// namespace ns starting with prefix that comes before from, or "" if there
+// are no titles before from.
+func (idx *titleIndex) pageBefore(prefix, from string, ns int, limit int) string {
+	var first string
+	n := 0
+	for i := idx.find(from) - 1; i >= 0 && n < limit; {
+		title, entry := idx.titleAt(i)
+		if !strings.HasPrefix(title, prefix) {
+			break
+		}
+		if entry.ns != ns {
+			// Skip back past every title in the other namespace.
+			i = idx.find(title[:strings.IndexByte(title, ':')+1]) - 1
+			continue
+		}
+		first = title
+		n++
+		i--
+	}
+	return first
+}
+
+type namespaceOption struct {
+	ID       int
+	Name     string
+	Selected bool
+}
+
+// handleAllPages serves Special:AllPages and Special:PrefixIndex, which list
+// the titles in a namespace alphabetically. arg is the title to start from
+// or, for Special:PrefixIndex, the prefix to list.
+func (wk *wiki) handleAllPages(w http.ResponseWriter, r *http.Request, arg string, prefixIndex bool) error {
+	namespaces := wk.namespaces()
+
+	ns := nsMain
+	if s := r.FormValue("namespace"); s != "" {
+		var ok bool
+		if ns, ok = namespaces.parse(s); !ok || ns < 0 {
+			return statusErrorf(http.StatusBadRequest, "unknown namespace %q", s)
+		}
+	}
+
+	var prefix, from string
+	if prefixIndex {
+		prefix = arg
+		if prefix == "" {
+			prefix = r.FormValue("prefix")
+		}
+		from = r.FormValue("from")
+	} else {
+		from = arg
+		if from == "" {
+			from = r.FormValue("from")
+		}
+	}
+	// Titles given with a namespace prefix select that namespace.
+	if prefix != "" {
+		if prefixNS, rest := namespaces.split(namespaces.normalize(prefix)); prefixNS != nsMain {
+			ns, prefix = prefixNS, rest
+		}
+	}
+	if from != "" {
+		if fromNS, rest := namespaces.split(namespaces.normalize(from)); fromNS == ns {
+			from = rest
+		}
+	}
+
+	nsPrefix := namespaces.prefix(ns)
+	fullPrefix := nsPrefix
+	if prefix != "" {
+		fullPrefix += namespaces.normalize(prefix)
+	}
+	fullFrom := fullPrefix
+	if from != "" {
+		fullFrom = nsPrefix + namespaces.normalize(from)
+	}
+
+	titles := wk.titles()
+	list := titles.prefixSearchFrom(fullPrefix, fullFrom, ns, true, allPagesLimit+1)
+
+	name := "AllPages"
+	title := "All pages"
+	if prefixIndex {
+		name = "PrefixIndex"
+		title = "Pages with prefix"
+	}
+	pageURL := func(from string) string {
+		v := url.Values{}
+		v.Set("from", strings.TrimPrefix(from, nsPrefix))
+		v.Set("namespace", strconv.Itoa(ns))
+		if prefixIndex {
+			v.Set("prefix", prefix)
+		}
+		return wk.articleURL(namespaces.prefix(nsSpecial)+name) + "?" + v.Encode()
+	}
+
+	data := struct {
+		pageData
+		Title       string
+		Action      string
+		PrefixIndex bool
+		Prefix      string
+		From        string
+		Namespaces  []namespaceOption
+		Results     []link
+		Prev, Next  string
+	}{
+		pageData:    wk.pageData(),
+		Title:       title,
+		Action:      wk.articleURL(namespaces.prefix(nsSpecial) + name),
+		PrefixIndex: prefixIndex,
+		Prefix:      prefix,
+		From:        from,
+	}
+	for id, name := range namespaces.names {
+		if id < 0 {
+			continue
+		}
+		if id == nsMain {
+			name = "(Main)"
+		}
+		data.Namespaces = append(data.Namespaces, namespaceOption{
+			ID:       id,
+			Name:     name,
+			Selected: id == ns,
+		})
+	}
+	sort.Slice(data.Namespaces, func(i, j int) bool {
+		return data.Namespaces[i].ID < data.Namespaces[j].ID
+	})
+
+	if len(list) > allPagesLimit {
+		data.Next = pageURL(list[allPagesLimit])
+		list = list[:allPagesLimit]
+	}
+	for _, t := range list {
+		data.Results = append(data.Results, link{
+			Title: t,
+			URL:   wk.articleURL(t),
+		})
+	}
+	if prev := titles.pageBefore(fullPrefix, fullFrom, ns, allPagesLimit); prev != "" {
+		data.Prev = pageURL(prev)
+	}
+	return executeTemplate(w, "allpages.html", data)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPageBefore(t *testing.T) {
+	idx := testTitleIndex(t,
+		[]string{"A", "B", "Category:Cats", "Category:Dogs", "D", "E", "Template:Cat"},
+		[]indexEntry{{ns: nsMain}, {ns: nsMain}, {ns: nsCategory}, {ns: nsCategory}, {ns: nsMain}, {ns: nsMain}, {ns: nsTemplate}},
+	)
+
+	if got, want := idx.prefixSearchFrom("", "B", nsMain, true, 3), []string{"B", "D", "E"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("prefixSearchFrom got %q; not %q", got, want)
+	}
+
+	cases := []struct {
+		prefix, from string
+		ns, limit    int
+		want         string
+	}{
+		{"", "E", nsMain, 2, "B"},
+		{"", "E", nsMain, 10, "A"},
+		{"", "D", nsMain, 1, "B"},
+		{"", "A", nsMain, 10, ""},
+		{"Category:", "Category:Dogs", nsCategory, 10, "Category:Cats"},
+		{"Category:", "Category:Cats", nsCategory, 10, ""},
+	}
+	for _, c := range cases {
+		if got := idx.pageBefore(c.prefix, c.from, c.ns, c.limit); got != c.want {
+			t.Errorf("pageBefore(%q, %q, %d, %d) = %q; not %q", c.prefix, c.from, c.ns, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestHandleAllPages(t *testing.T) {
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wk := loadTestWiki(t, dir)
+
+	cases := []struct {
+		path       string
+		want, skip []string
+	}{
+		{"/wiki/Special:AllPages", []string{">Page 1<", ">Page 10<", "Next page"}, []string{"Template:", "Previous page"}},
+		{"/wiki/Special:AllPages?from=Page+99", []string{">Page 99<", "Previous page"}, []string{">Page 1<", "Next page"}},
+		{"/wiki/Special:PrefixIndex/Template:Box_1", []string{">Template:Box 100<", ">Template:Box 150<"}, []string{">Template:Box 50<", ">Page 1<"}},
+		{"/wiki/Special:PrefixIndex?prefix=Box+5&namespace=10", []string{">Template:Box 50<"}, []string{">Template:Box 100<"}},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		if err := wk.handleArticle(w, httptest.NewRequest("GET", c.path, nil)); err != nil {
+			t.Errorf("%s: %+v", c.path, err)
+			continue
+		}
+		body := w.Body.String()
+		for _, s := range c.want {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: missing %q", c.path, s)
+			}
+		}
+		for _, s := range c.skip {
+			if strings.Contains(body, s) {
+				t.Errorf("%s: shouldn't contain %q", c.path, s)
+			}
+		}
+	}
+}
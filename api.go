@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// jsonHandler serves the value returned by f as JSON. Errors are returned as
+// a JSON object with the status from statusErrorf. Requests made while the
+// index is loading get a 503.
+func (wk *wiki) jsonHandler(f func(w http.ResponseWriter, r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var v interface{}
+		var err error
+		if progress := wk.status.progress(); !progress.Ready {
+			w.Header().Set("Retry-After", "10")
+			err = statusErrorf(http.StatusServiceUnavailable, "loading: %s", progress)
+		} else {
+			v, err = f(w, r)
+		}
+
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusInternalServerError
+			if cause, ok := errors.Cause(err).(statusError); ok {
+				status = int(cause)
+			}
+			v = struct {
+				Error string `json:"error"`
+			}{
+				Error: err.Error(),
+			}
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		}
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// pageInfo is the metadata about a page returned by /api/page/.
+type pageInfo struct {
+	Title     string `json:"title"`
+	ID        int    `json:"id"`
+	Namespace int    `json:"namespace"`
+	// NamespaceName is empty for the main namespace.
+	NamespaceName string        `json:"namespaceName"`
+	Redirect      *redirectInfo `json:"redirect,omitempty"`
+	RevisionID    string        `json:"revisionId"`
+	Timestamp     string        `json:"timestamp"`
+	Contributor   contributor   `json:"contributor"`
+	Model         string        `json:"model"`
+	Format        string        `json:"format"`
+	// Length is the length of the wikitext in bytes.
+	Length   int    `json:"length"`
+	URL      string `json:"url"`
+	Wikitext string `json:"wikitext,omitempty"`
+	HTML     string `json:"html,omitempty"`
+}
+
+type redirectInfo struct {
+	Title    string `json:"title"`
+	Fragment string `json:"fragment,omitempty"`
+}
+
+type contributor struct {
+	Username string `json:"username,omitempty"`
+	ID       string `json:"id,omitempty"`
+	IP       string `json:"ip,omitempty"`
+}
+
+// handlePage serves /api/page/{title} with the metadata of a page. Redirects
+// aren't followed. The content parameter picks what text is included: the
+// wikitext (the default), the rendered "html" or "none".
+func (wk *wiki) handlePage(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	content := r.FormValue("content")
+	switch content {
+	case "":
+		content = "wikitext"
+	case "wikitext", "html", "none":
+	default:
+		return nil, statusErrorf(http.StatusBadRequest, "unknown content %q; want wikitext, html or none", content)
+	}
+
+	name := requestTitle(r, wk.base()+"/api/page/")
+	if name == "" {
+		return nil, statusErrorf(http.StatusBadRequest, "missing title")
+	}
+	p, err := wk.fetchPage(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := pageInfo{
+		Title:         p.Title,
+		ID:            p.ID,
+		Namespace:     p.NS,
+		NamespaceName: strings.TrimSuffix(wk.namespaces().prefix(p.NS), ":"),
+		RevisionID:    p.RevisionID,
+		Timestamp:     p.Timestamp,
+		Contributor: contributor{
+			Username: p.Username,
+			ID:       p.UserID,
+			IP:       p.IP,
+		},
+		Model:  p.Model,
+		Format: p.Format,
+		Length: len(p.Text),
+		URL:    baseURL(r) + wk.articleURL(p.Title),
+	}
+	if target, fragment, ok := p.redirectTarget(); ok {
+		info.Redirect = &redirectInfo{Title: target, Fragment: fragment}
+	}
+	switch content {
+	case "wikitext":
+		info.Wikitext = p.Text
+	case "html":
+		body, err := wk.renderPage(p)
+		if err != nil {
+			return nil, err
+		}
+		info.HTML = string(body)
+	}
+	return info, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHandlePage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wk := loadTestWiki(t, dir)
+	wk.status.setReady()
+	handler := wk.jsonHandler(wk.handlePage)
+
+	get := func(path string, code int) pageInfo {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Fatalf("%s: got status %d; not %d: %s", path, w.Code, code, w.Body)
+		}
+		var info pageInfo
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	info := get("/api/page/Template:Box_50", http.StatusOK)
+	if info.Title != "Template:Box 50" || info.Namespace != nsTemplate || info.NamespaceName != "Template" {
+		t.Errorf("got title %q in namespace %d %q", info.Title, info.Namespace, info.NamespaceName)
+	}
+	if info.Wikitext == "" || info.Length != len(info.Wikitext) || info.HTML != "" {
+		t.Errorf("got wikitext %q with length %d and html %q", info.Wikitext, info.Length, info.HTML)
+	}
+	if info.ID != 50 || info.RevisionID != "1050" || info.Redirect != nil {
+		t.Errorf("got %+v", info)
+	}
+
+	info = get("/api/page/Page_1?content=html", http.StatusOK)
+	if info.Wikitext != "" || !strings.Contains(info.HTML, "<") || info.NamespaceName != "" {
+		t.Errorf("got %+v", info)
+	}
+	if info = get("/api/page/Page_1?content=none", http.StatusOK); info.Wikitext != "" || info.HTML != "" || info.Length == 0 {
+		t.Errorf("got %+v", info)
+	}
+
+	get("/api/page/Page_1?content=pdf", http.StatusBadRequest)
+	get("/api/page/No_such_page", http.StatusNotFound)
+}
+
+func TestHandlePageContributor(t *testing.T) {
+	withContributor := func(page, contributor string) string {
+		return strings.Replace(page, "<revision>", "<revision>\n      <contributor>"+contributor+"</contributor>", 1)
+	}
+	wk, dir := writeTestDump(t,
+		withContributor(testPage(1, "Anonymous", "Text"), "<ip>192.0.2.1</ip>"),
+		withContributor(testPage(2, "Registered", "Text"), "<username>Alice</username><id>42</id>"),
+	)
+	defer os.RemoveAll(dir)
+	wk.status.setReady()
+	handler := wk.jsonHandler(wk.handlePage)
+
+	cases := []struct {
+		title string
+		want  contributor
+	}{
+		{"Anonymous", contributor{IP: "192.0.2.1"}},
+		{"Registered", contributor{Username: "Alice", ID: "42"}},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/api/page/"+c.title, nil))
+		var info pageInfo
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		if info.Contributor != c.want {
+			t.Errorf("%s has contributor %+v; not %+v", c.title, info.Contributor, c.want)
+		}
+	}
+}
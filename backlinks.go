@@ -0,0 +1,276 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/d4l3k/wikigopher/wikitext"
+)
+
+// backlinkIndexMagic identifies a backlink index file. The last byte is the
+// format version.
+var backlinkIndexMagic = [8]byte{'w', 'g', 'l', 'n', 'k', 'i', 'd', 1}
+
+// The ways a page can refer to another.
+const (
+	backlinkLink         = 'l'
+	backlinkTransclusion = 't'
+	backlinkRedirect     = 'r'
+)
+
+const (
+	defaultBacklinkLimit = 50
+	maxBacklinkLimit     = 500
+)
+
+// backlinkKey returns the key stored in the backlink index for a reference
+// from source to target. Keys sort by target and then source so every page
+// referring to a target is listed together.
+func backlinkKey(target, source string, kind byte) string {
+	return target + "\x00" + source + "\x00" + string(kind)
+}
+
+// backlinkIndex maps pages to the pages that link to, transclude or redirect
+// to them. Like the category index it's only available if -backlinks has been
+// run.
+type backlinkIndex struct {
+	keyIndex
+}
+
+// ref returns the source and kind of the reference at i.
+func (idx *backlinkIndex) ref(i int) (source string, kind byte) {
+	key := idx.key(i)
+	key = key[strings.IndexByte(key, 0)+1:]
+	return key[:len(key)-2], key[len(key)-1]
+}
+
+func (wk *wiki) backlinks() *backlinkIndex {
+	return wk.snapshot().backlinks
+}
+
+func (wk *wiki) backlinkIndexPath() string {
+	return strings.TrimSuffix(wk.indexCachePath(), ".idx") + ".links.idx"
+}
+
+// loadBacklinkIndex loads the backlink index, building it first if
+// -backlinks is set and it's missing or out of date.
+func (wk *wiki) loadBacklinkIndex() error {
+	idx, err := wk.loadKeyIndex("backlink", wk.backlinkIndexPath(), backlinkIndexMagic, *backlinks, func(p page, entry indexEntry) []string {
+		return wk.pageRefs(p)
+	})
+	if err != nil || idx == nil {
+		return err
+	}
+
+	wk.updateSnapshot(func(s *snapshot) {
+		s.backlinks = &backlinkIndex{*idx}
+	})
+	return nil
+}
+
+// templateTitle returns the title of the page {{name}} transcludes.
+func (wk *wiki) templateTitle(name string) string {
+	namespaces := wk.namespaces()
+	if strings.HasPrefix(name, ":") {
+		return namespaces.normalize(name[1:])
+	}
+	title := namespaces.normalize(name)
+	if ns, _ := namespaces.split(title); ns != nsMain {
+		return title
+	}
+	return namespaces.normalize(namespaces.prefix(nsTemplate) + name)
+}
+
+// pageRefs returns the backlink index keys for the links and templates on
+// p. Redirects only refer to their target.
+func (wk *wiki) pageRefs(p page) []string {
+	namespaces := wk.namespaces()
+	if target, _, ok := p.redirectTarget(); ok {
+		return []string{backlinkKey(namespaces.normalize(target), p.Title, backlinkRedirect)}
+	}
+
+	var keys []string
+	seen := map[string]bool{}
+	add := func(target string, kind byte) {
+		key := backlinkKey(target, p.Title, kind)
+		if target != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	text := []byte(p.Text)
+	for _, link := range wikitext.Links(text) {
+		if wk.isCategoryLink(link.Target) {
+			continue
+		}
+		target := strings.TrimPrefix(link.Target, ":")
+		if i := strings.IndexByte(target, '#'); i >= 0 {
+			target = target[:i]
+		}
+		add(namespaces.normalize(target), backlinkLink)
+	}
+	for _, name := range wikitext.Templates(text) {
+		add(wk.templateTitle(name), backlinkTransclusion)
+	}
+	return keys
+}
+
+// backlink is a page referring to the target of Special:WhatLinksHere.
+type backlink struct {
+	Title, URL string
+	// LinksURL is the Special:WhatLinksHere page of redirects, which often
+	// have links of their own.
+	LinksURL                     string
+	Link, Transclusion, Redirect bool
+}
+
+// backlinkFilter holds which kinds of references are hidden.
+type backlinkFilter struct {
+	HideLinks, HideTrans, HideRedirs bool
+}
+
+func (f backlinkFilter) visible(b backlink) bool {
+	return (b.Link && !f.HideLinks) || (b.Transclusion && !f.HideTrans) || (b.Redirect && !f.HideRedirs)
+}
+
+// group returns the references from the source at i and the position after
+// them. If back is set the group ending at i is returned instead along with
+// the position before it.
+func (idx *backlinkIndex) group(i, lo, hi int, back bool) (backlink, int) {
+	source, _ := idx.ref(i)
+	var b backlink
+	b.Title = source
+	step := 1
+	if back {
+		step = -1
+	}
+	for ; i >= lo && i < hi; i += step {
+		s, kind := idx.ref(i)
+		if s != source {
+			break
+		}
+		switch kind {
+		case backlinkLink:
+			b.Link = true
+		case backlinkTransclusion:
+			b.Transclusion = true
+		case backlinkRedirect:
+			b.Redirect = true
+		}
+	}
+	return b, i
+}
+
+// handleWhatLinksHere serves Special:WhatLinksHere, which lists the pages that
+// link to, transclude or redirect to the page arg.
+func (wk *wiki) handleWhatLinksHere(w http.ResponseWriter, r *http.Request, arg string) error {
+	namespaces := wk.namespaces()
+	if arg == "" {
+		arg = r.FormValue("target")
+	}
+	target := namespaces.normalize(arg)
+
+	limit := defaultBacklinkLimit
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return statusErrorf(http.StatusBadRequest, "invalid limit %q", s)
+		}
+		if limit > maxBacklinkLimit {
+			limit = maxBacklinkLimit
+		}
+	}
+	filter := backlinkFilter{
+		HideLinks:  r.FormValue("hidelinks") == "1",
+		HideTrans:  r.FormValue("hidetrans") == "1",
+		HideRedirs: r.FormValue("hideredirs") == "1",
+	}
+	from := r.FormValue("from")
+
+	pageURL := func(change func(q url.Values)) string {
+		q := r.URL.Query()
+		q.Del("target")
+		change(q)
+		u := wk.articleURL(namespaces.prefix(nsSpecial) + "WhatLinksHere/" + target)
+		if len(q) > 0 {
+			u += "?" + q.Encode()
+		}
+		return u
+	}
+	toggle := func(param string, hidden bool) string {
+		return pageURL(func(q url.Values) {
+			q.Del("from")
+			if hidden {
+				q.Del(param)
+			} else {
+				q.Set(param, "1")
+			}
+		})
+	}
+
+	data := struct {
+		pageData
+		Title                                  string
+		Target                                 link
+		Filter                                 backlinkFilter
+		ToggleLinks, ToggleTrans, ToggleRedirs string
+		Unavailable                            bool
+		Results                                []backlink
+		Prev, Next                             string
+	}{
+		pageData:     wk.pageData(),
+		Title:        "Pages that link to " + target,
+		Target:       link{Title: target, URL: wk.articleURL(target)},
+		Filter:       filter,
+		ToggleLinks:  toggle("hidelinks", filter.HideLinks),
+		ToggleTrans:  toggle("hidetrans", filter.HideTrans),
+		ToggleRedirs: toggle("hideredirs", filter.HideRedirs),
+	}
+
+	idx := wk.backlinks()
+	if idx == nil {
+		data.Unavailable = true
+		return executeTemplate(w, "whatlinkshere.html", data)
+	}
+
+	lo, hi := idx.span(target + "\x00")
+	start := lo
+	if from != "" {
+		start, _ = idx.span(target + "\x00" + namespaces.normalize(from) + "\x00")
+	}
+	for i := start; i < hi; {
+		b, next := idx.group(i, lo, hi, false)
+		if filter.visible(b) {
+			if len(data.Results) == limit {
+				data.Next = pageURL(func(q url.Values) { q.Set("from", b.Title) })
+				break
+			}
+			b.URL = wk.articleURL(b.Title)
+			if b.Redirect {
+				b.URL += "?redirect=no"
+				b.LinksURL = wk.articleURL(namespaces.prefix(nsSpecial) + "WhatLinksHere/" + b.Title)
+			}
+			data.Results = append(data.Results, b)
+		}
+		i = next
+	}
+
+	// Walk back to find where the previous page starts.
+	var prev string
+	n := 0
+	for i := start - 1; i >= lo && n < limit; {
+		var b backlink
+		b, i = idx.group(i, lo, hi, true)
+		if filter.visible(b) {
+			prev = b.Title
+			n++
+		}
+	}
+	if prev != "" {
+		data.Prev = pageURL(func(q url.Values) { q.Set("from", prev) })
+	}
+	return executeTemplate(w, "whatlinkshere.html", data)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBacklinks(t *testing.T) {
+	old := *backlinks
+	defer func() { *backlinks = old }()
+	*backlinks = true
+	// Write a run per stream to merge.
+	defer func(n int) { keyRunBytes = n }(keyRunBytes)
+	keyRunBytes = 1
+
+	wk, dir := writeTestDump(t,
+		testPage(1, "Target", "Text"),
+		testPage(2, "Alpha", "[[Target]] and [[target|again]] {{Box|x={{nowrap|y}}}}"),
+		testPage(3, "Beta", "[[Target#History]] [[Category:Target]] {{NPOV}} {{PAGENAME}}"),
+		testRedirect(4, "Gamma", "Target", "#REDIRECT [[Target]]"),
+		testPage(5, "Delta", "{{:Target}}"),
+	)
+	defer os.RemoveAll(dir)
+	if err := wk.loadBacklinkIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(path string) (titles []string, body string) {
+		w := httptest.NewRecorder()
+		if err := wk.handleArticle(w, httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("%s: %+v", path, err)
+		}
+		body = w.Body.String()
+		i := strings.Index(body, `<ul class="backlinks">`)
+		if i < 0 {
+			return nil, body
+		}
+		for _, line := range strings.Split(body[i:strings.Index(body, "</ul>")], "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "<a href=") {
+				continue
+			}
+			title := line[strings.IndexByte(line, '>')+1:]
+			titles = append(titles, title[:strings.IndexByte(title, '<')])
+		}
+		return titles, body
+	}
+
+	cases := []struct {
+		path string
+		want []string
+	}{
+		{"/wiki/Special:WhatLinksHere/Target", []string{"Alpha", "Beta", "Delta", "Gamma"}},
+		{"/wiki/Special:WhatLinksHere/Target?hidelinks=1", []string{"Delta", "Gamma"}},
+		{"/wiki/Special:WhatLinksHere/Target?hidelinks=1&hideredirs=1", []string{"Delta"}},
+		{"/wiki/Special:WhatLinksHere?target=Template:Box", []string{"Alpha"}},
+		{"/wiki/Special:WhatLinksHere/Template:Nowrap", []string{"Alpha"}},
+		{"/wiki/Special:WhatLinksHere/Template:NPOV", []string{"Beta"}},
+		{"/wiki/Special:WhatLinksHere/Template:PAGENAME", nil},
+		{"/wiki/Special:WhatLinksHere/Category:Target", nil},
+		{"/wiki/Special:WhatLinksHere/Target?limit=2&from=Beta", []string{"Beta", "Delta"}},
+	}
+	for _, c := range cases {
+		if got, _ := list(c.path); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s listed %q; not %q", c.path, got, c.want)
+		}
+	}
+
+	_, body := list("/wiki/Special:WhatLinksHere/Target?limit=2&from=Beta")
+	for _, s := range []string{"from=Alpha", "from=Gamma"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("paged list should link to %s", s)
+		}
+	}
+}
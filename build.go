@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/d4l3k/wikigopher/wikitext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+const (
+	// buildCheckpointFile records the last stream that was fully written so a
+	// build can resume.
+	buildCheckpointFile = ".build-checkpoint"
+	// buildFailuresFile lists the pages that failed to render, one per line
+	// with the error after a tab.
+	buildFailuresFile = "build-failures.txt"
+)
+
+// buildCommand runs `wikigopher build`, which renders every main namespace
+// article to a static site in -out that can be served by any web server.
+func buildCommand(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("build takes no arguments")
+	}
+	if err := loadTemplates(); err != nil {
+		return err
+	}
+	for _, wk := range wikis {
+		wk.cache = newStreamCache(int64(*cacheSize) << 20)
+		if err := wk.loadTitles(); err != nil {
+			return err
+		}
+		b := siteBuilder{wk: wk, out: *outDir}
+		if wk.name != "" {
+			b.prefix = wk.name + "/"
+		}
+		if err := b.build(*fullTextWorkers); err != nil {
+			return err
+		}
+	}
+	return copyDir("static", filepath.Join(*outDir, "static"))
+}
+
+// siteBuilder writes the static site of a wiki. Articles are written to
+// wiki/Title.html under the wiki's directory and links between them are
+// rewritten to relative links to those files.
+type siteBuilder struct {
+	wk *wiki
+	// out is the root directory of the site, which may have several wikis.
+	out string
+	// prefix is the directory of the wiki under out, "" or "name/".
+	prefix string
+
+	mu       sync.Mutex
+	failures io.Writer
+	built    int
+	failed   int
+}
+
+// build writes every article of the wiki, resuming after the last checkpoint
+// if the dump hasn't changed since.
+func (b *siteBuilder) build(workers int) error {
+	wk := b.wk
+	dir := filepath.Join(b.out, filepath.FromSlash(b.prefix))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	source, err := wk.indexSource()
+	if err != nil {
+		return err
+	}
+
+	streams := wk.titles().streams()
+	checkpointPath := filepath.Join(dir, buildCheckpointFile)
+	failuresFlags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if seek, ok := readBuildCheckpoint(checkpointPath, source); ok {
+		streams = streamsAfter(streams, seek)
+		failuresFlags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		log.Printf("Resuming build with %d streams left", len(streams))
+	}
+	f, err := os.OpenFile(filepath.Join(dir, buildFailuresFile), failuresFlags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	failures := bufio.NewWriter(f)
+	b.failures = failures
+
+	if err := b.writeIndex(); err != nil {
+		return err
+	}
+
+	titles := wk.titles()
+	namespaces := wk.namespaces()
+	log.Printf("Building %d streams into %q...", len(streams), dir)
+	done := 0
+	if err := wk.walkStreams(streams, workers, func(seek int, pages []page) error {
+		for _, p := range pages {
+			// Skip pages that have been replaced by an incremental dump.
+			entry, ok := titles.lookup(namespaces.normalize(p.Title))
+			if !ok || entry.id != p.ID || entry.seek != seek || entry.ns != nsMain {
+				continue
+			}
+			if err := b.writeArticle(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(seek int) error {
+		done++
+		if done%1000 == 0 {
+			log.Printf("Built %d/%d streams", done, len(streams))
+		}
+		// Failures must be on disk before the checkpoint passes them.
+		b.mu.Lock()
+		err := failures.Flush()
+		b.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(checkpointPath, []byte(source+"\n"+strconv.Itoa(seek)+"\n"), 0644)
+	}); err != nil {
+		return err
+	}
+	if err := failures.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Built %d articles into %q, %d failed to render (see %s)", b.built, dir, b.failed, buildFailuresFile)
+	return nil
+}
+
+// readBuildCheckpoint returns the last stream written by a build of source.
+func readBuildCheckpoint(path, source string) (int, bool) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 2 || lines[0] != source {
+		return 0, false
+	}
+	seek, err := strconv.Atoi(lines[1])
+	if err != nil {
+		return 0, false
+	}
+	return seek, true
+}
+
+// articleFile returns the path of the file for title relative to out.
+func (b *siteBuilder) articleFile(title string) string {
+	return b.prefix + "wiki/" + strings.Replace(title, " ", "_", -1) + ".html"
+}
+
+// writeIndex writes index.html, which redirects to the main page.
+func (b *siteBuilder) writeIndex() error {
+	mainPage := b.wk.mainPage()
+	return b.write(b.prefix+"index.html", "static-redirect.html", articlePage{
+		pageData:   b.pageData(),
+		Title:      mainPage,
+		RedirectTo: &link{Title: mainPage, URL: b.wk.articleURL(mainPage)},
+	})
+}
+
+func (b *siteBuilder) pageData() pageData {
+	data := b.wk.pageData()
+	data.Static = true
+	return data
+}
+
+// writeArticle renders p to its file. Pages that fail to render are recorded
+// in the failures file rather than stopping the build.
+func (b *siteBuilder) writeArticle(p page) error {
+	var err error
+	if p.isRedirect() {
+		err = b.write(b.articleFile(p.Title), "static-redirect.html", articlePage{
+			pageData:   b.pageData(),
+			Title:      p.Title,
+			RedirectTo: b.wk.redirectLink(p),
+		})
+	} else {
+		var body []byte
+		body, err = b.render(p)
+		if err == nil {
+			err = b.write(b.articleFile(p.Title), "article.html", articlePage{
+				pageData:   b.pageData(),
+				Title:      p.Title,
+				Body:       template.HTML(body),
+				Categories: b.wk.categoryLinks(p),
+			})
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil {
+		b.failed++
+		_, err := fmt.Fprintf(b.failures, "%s\t%s\n", p.Title, strings.Replace(err.Error(), "\n", " ", -1))
+		return err
+	}
+	b.built++
+	return nil
+}
+
+// render converts p to HTML, turning panics in the converter into errors.
+func (b *siteBuilder) render(p page) (body []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("panic: %v", r)
+		}
+	}()
+	return b.wk.renderPage(p)
+}
+
+// write executes the template name and writes it to file with its links
+// rewritten.
+func (b *siteBuilder) write(file, name string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := executeTemplate(&buf, name, data); err != nil {
+		return err
+	}
+	out, err := b.rewriteLinks(file, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.out, filepath.FromSlash(file))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// rewriteLinks rewrites the links in the page for file to point at the
+// files of the static site. Links to pages that aren't in the site lose their
+// href.
+func (b *siteBuilder) rewriteLinks(file string, page []byte) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			attrs := n.Attr[:0]
+			for _, attr := range n.Attr {
+				switch {
+				case attr.Key == "href" || attr.Key == "src":
+					u, ok := b.rewriteURL(file, attr.Val)
+					if !ok {
+						continue
+					}
+					attr.Val = u
+				case attr.Key == "content" && n.Data == "meta":
+					if i := strings.Index(attr.Val, "url="); i >= 0 {
+						if u, ok := b.rewriteURL(file, attr.Val[i+len("url="):]); ok {
+							attr.Val = attr.Val[:i+len("url=")] + u
+						}
+					}
+				}
+				attrs = append(attrs, attr)
+			}
+			n.Attr = attrs
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rewriteURL returns the URL of u relative to file, or false if it's a link
+// into the server that isn't part of the static site.
+func (b *siteBuilder) rewriteURL(file, u string) (string, bool) {
+	base := b.wk.base()
+	var target string
+	switch {
+	case strings.HasPrefix(u, "./"):
+		target = u[len("./"):]
+	case strings.HasPrefix(u, base+"/wiki/"):
+		target = u[len(base+"/wiki/"):]
+		if i := strings.IndexByte(target, '?'); i >= 0 {
+			target = target[:i]
+		}
+	case strings.HasPrefix(u, "/static/"):
+		return relativeURL(file, u[1:]), true
+	case u == "/" || u == base+"/":
+		return relativeURL(file, b.prefix+"index.html"), true
+	case strings.HasPrefix(u, "/"):
+		return "", false
+	default:
+		return u, true
+	}
+
+	var fragment string
+	if i := strings.IndexByte(target, '#'); i >= 0 {
+		target, fragment = target[:i], target[i:]
+	}
+	if target == "" {
+		return fragment, true
+	}
+	title := b.wk.namespaces().normalize(wikitext.URLToTitle(target))
+	if entry, ok := b.wk.titles().lookup(title); !ok || entry.ns != nsMain {
+		return "", false
+	}
+	return relativeURL(file, b.articleFile(title)) + fragment, true
+}
+
+// relativeURL returns the URL of the file to relative to the file from, both
+// given relative to the root of the site.
+func relativeURL(from, to string) string {
+	segments := strings.Split(to, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Repeat("../", strings.Count(from, "/")) + strings.Join(segments, "/")
+}
+
+// copyDir copies the files under src to dst.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRelativeURL(t *testing.T) {
+	cases := []struct {
+		from, to, want string
+	}{
+		{"index.html", "wiki/Main_Page.html", "wiki/Main_Page.html"},
+		{"wiki/A.html", "wiki/B.html", "../wiki/B.html"},
+		{"enwiki/wiki/AC/DC.html", "static/style.css", "../../../static/style.css"},
+		{"wiki/A.html", "wiki/What?_100%.html", "../wiki/What%3F_100%25.html"},
+	}
+	for _, c := range cases {
+		if got := relativeURL(c.from, c.to); got != c.want {
+			t.Errorf("relativeURL(%q, %q) = %q; not %q", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	wk, dir := writeTestDump(t,
+		testPage(1, "Main Page", "See [[AC/DC#Members|the band]], [[Missing]] and [[Category:Things]]."),
+		testPage(2, "AC/DC", "Back to the [[main Page]]."),
+		testRedirect(3, "ACDC", "AC/DC", "#REDIRECT [[AC/DC]]"),
+		testPage(4, "Category:Things", "Not built"),
+	)
+	defer os.RemoveAll(dir)
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "site")
+	b := siteBuilder{wk: wk, out: out}
+	if err := b.build(2); err != nil {
+		t.Fatal(err)
+	}
+	if b.built != 3 || b.failed != 0 {
+		t.Errorf("built %d pages and %d failed; not 3 and 0", b.built, b.failed)
+	}
+
+	read := func(file string) string {
+		buf, err := ioutil.ReadFile(filepath.Join(out, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	main := read("wiki/Main_Page.html")
+	for _, s := range []string{`href="../wiki/AC/DC.html#Members"`, `href="../static/style.css"`, `<a>Missing</a>`, `<a>Things</a>`} {
+		if !strings.Contains(main, s) {
+			t.Errorf("Main_Page.html doesn't contain %s: %s", s, main)
+		}
+	}
+	if strings.Contains(main, "/search") || strings.Contains(main, "Special:") {
+		t.Errorf("Main_Page.html links to the server: %s", main)
+	}
+	if s := read("wiki/AC/DC.html"); !strings.Contains(s, `href="../../wiki/Main_Page.html"`) {
+		t.Errorf("AC/DC.html doesn't link to the main page: %s", s)
+	}
+	if s := read("wiki/ACDC.html"); !strings.Contains(s, `content="0; url=../wiki/AC/DC.html"`) {
+		t.Errorf("ACDC.html doesn't redirect to AC/DC: %s", s)
+	}
+	if s := read("index.html"); !strings.Contains(s, "url=wiki/Main_Page.html") {
+		t.Errorf("index.html doesn't redirect to the main page: %s", s)
+	}
+	if _, err := os.Stat(filepath.Join(out, "wiki/Category:Things.html")); !os.IsNotExist(err) {
+		t.Errorf("pages outside the main namespace shouldn't be built: %v", err)
+	}
+
+	// A finished build has nothing left to do.
+	b = siteBuilder{wk: wk, out: out}
+	if err := b.build(2); err != nil {
+		t.Fatal(err)
+	}
+	if b.built != 0 {
+		t.Errorf("resumed build rebuilt %d pages", b.built)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+const (
+	bz2BlockMagic = 0x314159265359
+	bz2FinalMagic = 0x177245385090
+	bz2MagicMask  = 1<<48 - 1
+	// bz2MaxBlockBytes is more than the compressed size of any bzip2 block.
+	// Blocks hold at most 900k bytes and compressing never grows data by
+	// more than a few percent.
+	bz2MaxBlockBytes = 1 << 20
+)
+
+// bz2BlockReader reads a bzip2 file from an arbitrary block onwards. A bzip2
+// stream can only be decoded from its start, so every block is rewritten as a
+// stream of its own: a header is added in front of it and an end of stream
+// marker after it, using the block's CRC as the stream CRC. The output can be
+// decoded by compress/bzip2 which supports concatenated streams.
+//
+// Blocks aren't byte aligned so they are found by looking for the block magic
+// at every bit offset. The reader should be positioned at or just before the
+// first block to read.
+type bz2BlockReader struct {
+	r *bufio.Reader
+
+	// bit is the offset of the next bit to be read from r relative to where
+	// reading started.
+	bit int64
+	// window holds the last bits read. The lowest pending bits of it haven't
+	// been copied to the output yet in case they turn out to be a magic
+	// number.
+	window  uint64
+	pending uint
+	// inBlock is set while copying a block. crcBits counts the bits read of
+	// the block's CRC which follows the block magic.
+	inBlock bool
+	crcBits uint
+	crc     uint32
+
+	out    []byte
+	outBit uint64
+	outN   uint
+
+	// blockStart is the offset of the magic of the block being copied.
+	blockStart int64
+	// ends records where each stream in out ends for next.
+	ends []streamEnd
+	// lastBlock, if it's set, is the offset of the last block to copy.
+	// Reading stops at the block after it.
+	lastBlock    int64
+	hasLastBlock bool
+	err          error
+}
+
+type streamEnd struct {
+	n     int
+	start int64
+}
+
+func newBZ2BlockReader(r io.Reader) *bz2BlockReader {
+	return &bz2BlockReader{r: bufio.NewReader(r)}
+}
+
+func (b *bz2BlockReader) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.fill(len(p))
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	b.ends = b.ends[:0]
+	return n, nil
+}
+
+// next returns the next block as a complete bzip2 stream along with the bit
+// offset its block magic was found at. It shouldn't be mixed with Read.
+func (b *bz2BlockReader) next() ([]byte, int64, error) {
+	for len(b.ends) == 0 {
+		if b.err != nil {
+			return nil, 0, b.err
+		}
+		b.readByte()
+	}
+	end := b.ends[0]
+	b.ends = b.ends[1:]
+	stream := append([]byte(nil), b.out[:end.n]...)
+	b.out = b.out[end.n:]
+	for i := range b.ends {
+		b.ends[i].n -= end.n
+	}
+	return stream, end.start, nil
+}
+
+// fill reads input until at least n bytes of output are available or the
+// input runs out.
+func (b *bz2BlockReader) fill(n int) {
+	for b.err == nil && len(b.out) < n {
+		b.readByte()
+	}
+}
+
+func (b *bz2BlockReader) readByte() {
+	c, err := b.r.ReadByte()
+	if err != nil {
+		if err == io.EOF && b.inBlock {
+			// The file is truncated; pass on what there is.
+			b.flushPending(0)
+			err = io.ErrUnexpectedEOF
+		}
+		b.err = err
+		return
+	}
+	for i := 7; i >= 0 && b.err == nil; i-- {
+		b.readBit(uint64(c>>uint(i)) & 1)
+	}
+}
+
+func (b *bz2BlockReader) readBit(bit uint64) {
+	b.bit++
+	b.window = b.window<<1 | bit
+	if b.pending < 64 {
+		b.pending++
+	}
+
+	if b.inBlock && b.crcBits < 32 {
+		b.crcBits++
+		if b.crcBits == 32 {
+			b.crc = uint32(b.window)
+		}
+	}
+
+	if b.pending >= 48 {
+		switch b.window & bz2MagicMask {
+		case bz2BlockMagic:
+			if b.inBlock {
+				b.endStream()
+			}
+			if b.hasLastBlock && b.bit-48 > b.lastBlock {
+				b.err = io.EOF
+				return
+			}
+			b.blockStart = b.bit - 48
+			b.startStream()
+			return
+		case bz2FinalMagic:
+			if b.inBlock {
+				b.endStream()
+			}
+			return
+		}
+	}
+
+	if !b.inBlock {
+		if b.pending > 48 {
+			b.pending = 48
+		}
+		return
+	}
+	if b.pending > 48 {
+		b.pending--
+		b.writeBits(b.window>>b.pending&1, 1)
+	}
+}
+
+// startStream writes a stream header and the block magic which has just been
+// read.
+func (b *bz2BlockReader) startStream() {
+	b.inBlock = true
+	b.crcBits = 0
+	b.pending = 0
+	b.writeBits('B', 8)
+	b.writeBits('Z', 8)
+	b.writeBits('h', 8)
+	b.writeBits('9', 8)
+	b.writeBits(bz2BlockMagic, 48)
+}
+
+// endStream finishes the current block, which ended where the magic that has
+// just been read starts, with an end of stream marker.
+func (b *bz2BlockReader) endStream() {
+	b.flushPending(48)
+	b.writeBits(bz2FinalMagic, 48)
+	b.writeBits(uint64(b.crc), 32)
+	if b.outN > 0 {
+		b.writeBits(0, 8-b.outN)
+	}
+	b.ends = append(b.ends, streamEnd{n: len(b.out), start: b.blockStart})
+	b.inBlock = false
+	b.pending = 0
+}
+
+// flushPending copies all but the last keep pending bits to the output.
+func (b *bz2BlockReader) flushPending(keep uint) {
+	for b.pending > keep {
+		b.pending--
+		b.writeBits(b.window>>b.pending&1, 1)
+	}
+}
+
+func (b *bz2BlockReader) writeBits(v uint64, n uint) {
+	for n > 0 {
+		n--
+		b.outBit = b.outBit<<1 | v>>n&1
+		b.outN++
+		if b.outN == 8 {
+			b.out = append(b.out, byte(b.outBit))
+			b.outBit = 0
+			b.outN = 0
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+)
+
+var (
+	streamCacheHits   = expvar.NewInt("streamCacheHits")
+	streamCacheMisses = expvar.NewInt("streamCacheMisses")
+)
+
+// streamCache is an LRU cache of decoded pages keyed by stream. The pages of a
+// stream are cached together since templates and modules tend to be looked up
+// many times while rendering a single article. A cached stream may only hold
+// its first pages until a read misses and it's loaded whole.
+type streamCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	streams  map[streamKey]*list.Element
+}
+
+// streamKey identifies a cached stream. Offsets only mean something together
+// with the title index they're from, which is replaced when the dumps are
+// reloaded, so streams from an old index are never returned for a new one and
+// are left to be evicted.
+type streamKey struct {
+	titles *titleIndex
+	seek   int
+}
+
+type cachedStream struct {
+	key   streamKey
+	pages []page
+	size  int64
+	err   error
+	// done is closed once pages has been loaded.
+	done chan struct{}
+}
+
+func newStreamCache(maxBytes int64) *streamCache {
+	return &streamCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		streams:  map[streamKey]*list.Element{},
+	}
+}
+
+// get returns the pages in the stream at key, calling load if they aren't
+// cached. Concurrent calls for the same stream share a single load.
+func (c *streamCache) get(key streamKey, load func() ([]page, error)) ([]page, error) {
+	c.mu.Lock()
+	if e, ok := c.streams[key]; ok {
+		c.ll.MoveToFront(e)
+		c.mu.Unlock()
+		streamCacheHits.Add(1)
+
+		s := e.Value.(*cachedStream)
+		<-s.done
+		return s.pages, s.err
+	}
+	s := &cachedStream{
+		key:  key,
+		done: make(chan struct{}),
+	}
+	c.streams[key] = c.ll.PushFront(s)
+	c.mu.Unlock()
+	streamCacheMisses.Add(1)
+
+	s.pages, s.err = load()
+	for _, p := range s.pages {
+		s.size += p.size()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	close(s.done)
+	if s.err != nil {
+		c.remove(c.streams[key])
+		return nil, s.err
+	}
+	c.size += s.size
+	c.evict()
+	return s.pages, nil
+}
+
+// evict removes the least recently used streams until the cache fits in
+// maxBytes. Streams that are still loading aren't counted and are skipped.
+func (c *streamCache) evict() {
+	for e := c.ll.Back(); e != nil && c.size > c.maxBytes; {
+		prev := e.Prev()
+		select {
+		case <-e.Value.(*cachedStream).done:
+			c.remove(e)
+		default:
+		}
+		e = prev
+	}
+}
+
+// drop removes the stream at key so the next get loads it again. Streams that
+// are still loading are left alone.
+func (c *streamCache) drop(key streamKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.streams[key]
+	if !ok {
+		return
+	}
+	select {
+	case <-e.Value.(*cachedStream).done:
+		c.remove(e)
+	default:
+	}
+}
+
+func (c *streamCache) remove(e *list.Element) {
+	s := e.Value.(*cachedStream)
+	c.ll.Remove(e)
+	delete(c.streams, s.key)
+	if s.err == nil {
+		c.size -= s.size
+	}
+}
+
+// len returns the number of cached streams.
+func (c *streamCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestStreamCache(t *testing.T) {
+	c := newStreamCache(250)
+	loads := map[int]int{}
+	load := func(seek int) func() ([]page, error) {
+		return func() ([]page, error) {
+			loads[seek]++
+			return []page{
+				{ID: seek, Text: strings.Repeat("a", 50)},
+				{ID: seek + 1, Text: strings.Repeat("b", 50)},
+			}, nil
+		}
+	}
+
+	hits, misses := streamCacheHits.Value(), streamCacheMisses.Value()
+	for _, seek := range []int{100, 200, 100, 300, 200} {
+		pages, err := c.get(streamKey{seek: seek}, load(seek))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pages) != 2 || pages[0].ID != seek {
+			t.Fatalf("get(%d) = %+v", seek, pages)
+		}
+	}
+
+	// 100 and 200 fit, 300 evicts 200 as the least recently used stream.
+	want := map[int]int{100: 1, 200: 2, 300: 1}
+	for seek, n := range want {
+		if loads[seek] != n {
+			t.Errorf("stream %d loaded %d times; not %d", seek, loads[seek], n)
+		}
+	}
+	if c.len() != 2 {
+		t.Errorf("len() = %d; not 2", c.len())
+	}
+	if got := streamCacheHits.Value() - hits; got != 1 {
+		t.Errorf("hits = %d; not 1", got)
+	}
+	if got := streamCacheMisses.Value() - misses; got != 4 {
+		t.Errorf("misses = %d; not 4", got)
+	}
+}
+
+func TestStreamCacheError(t *testing.T) {
+	c := newStreamCache(1000)
+	if _, err := c.get(streamKey{seek: 1}, func() ([]page, error) {
+		return nil, errors.New("boom")
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+	if c.len() != 0 {
+		t.Errorf("errors shouldn't be cached, len() = %d", c.len())
+	}
+}
+
+func TestStreamCacheTitleIndex(t *testing.T) {
+	c := newStreamCache(1000)
+	before, after := &titleIndex{}, &titleIndex{}
+	loads := 0
+	load := func() ([]page, error) {
+		loads++
+		return []page{{ID: loads}}, nil
+	}
+	for _, titles := range []*titleIndex{before, after, before} {
+		if _, err := c.get(streamKey{titles: titles, seek: 1}, load); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A stream is loaded again once the title index changes.
+	if loads != 2 {
+		t.Errorf("loaded %d times; not 2", loads)
+	}
+}
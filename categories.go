@@ -0,0 +1,309 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/d4l3k/wikigopher/wikitext"
+)
+
+// categoryIndexMagic identifies a category index file. The last byte is the
+// format version.
+var categoryIndexMagic = [8]byte{'w', 'g', 'c', 'a', 't', 'i', 'd', 1}
+
+// Members of a category are listed in sections like on MediaWiki.
+const (
+	sectionSubcategories = iota
+	sectionPages
+	sectionFiles
+)
+
+var sectionTitles = [...]string{"Subcategories", "Pages", "Media"}
+
+// sectionParams are the query parameters that page through each section.
+var sectionParams = [...]string{"subcatfrom", "pagefrom", "filefrom"}
+
+// maxSortKeyLen is the longest sort key kept in bytes, the length of the
+// sort key prefix MediaWiki stores for each category member.
+const maxSortKeyLen = 255
+
+// categoryPageLimit is the number of members shown in each section of a
+// category page.
+const categoryPageLimit = 200
+
+func categorySection(ns int) int {
+	switch ns {
+	case nsCategory:
+		return sectionSubcategories
+	case nsFile:
+		return sectionFiles
+	}
+	return sectionPages
+}
+
+// categoryKey returns the key a member is stored under in the category index.
+// Keys sort by category, then section, then sort key and title so the
+// members of each section are next to each other in the order they're
+// listed.
+func categoryKey(category string, section int, sortKey, title string) string {
+	sortKey = strings.ToUpper(sortKey)
+	// Like MediaWiki only the start of long sort keys is kept, so every key
+	// in the index is about the size of a couple of titles.
+	if len(sortKey) > maxSortKeyLen {
+		n := maxSortKeyLen
+		for n > 0 && !utf8.RuneStart(sortKey[n]) {
+			n--
+		}
+		sortKey = sortKey[:n]
+	}
+	return sectionPrefix(category, section) + sortKey + "\x00" + title
+}
+
+// sectionPrefix is the prefix of the keys of every member of category in
+// section.
+func sectionPrefix(category string, section int) string {
+	return category + "\x00" + string('0'+rune(section))
+}
+
+// categoryIndex maps categories to their members. It's built by crawling
+// the whole dump so it's only available if -categories has been run.
+type categoryIndex struct {
+	keyIndex
+}
+
+// sectionSpan returns the range of members of category in section.
+func (idx *categoryIndex) sectionSpan(category string, section int) (lo, hi int) {
+	return idx.span(sectionPrefix(category, section))
+}
+
+// member returns the sort key and title of the member at i.
+func (idx *categoryIndex) member(i int) (sortKey, title string) {
+	key := idx.key(i)
+	key = key[strings.IndexByte(key, 0)+2:]
+	j := strings.IndexByte(key, 0)
+	return key[:j], key[j+1:]
+}
+
+func (wk *wiki) categories() *categoryIndex {
+	return wk.snapshot().categories
+}
+
+// pageCategory is a category a page is in along with the key the page is
+// sorted by in it.
+type pageCategory struct {
+	title, sortKey string
+}
+
+// pageCategories returns the categories p links to. Like MediaWiki the sort
+// key is the one given in the link, the page's {{DEFAULTSORT}} or the title
+// without its namespace.
+func (wk *wiki) pageCategories(p page) []pageCategory {
+	namespaces := wk.namespaces()
+	text := []byte(p.Text)
+	defaultSort := wikitext.DefaultSort(text)
+	if defaultSort == "" {
+		_, defaultSort = namespaces.split(p.Title)
+	}
+	var categories []pageCategory
+	seen := map[string]bool{}
+	for _, link := range wikitext.Links(text) {
+		if strings.HasPrefix(link.Target, ":") {
+			continue
+		}
+		title := namespaces.normalize(link.Target)
+		if ns, name := namespaces.split(title); ns != nsCategory || name == "" || seen[title] {
+			continue
+		}
+		seen[title] = true
+		sortKey := link.Text
+		if sortKey == "" {
+			sortKey = defaultSort
+		}
+		categories = append(categories, pageCategory{title: title, sortKey: sortKey})
+	}
+	return categories
+}
+
+// isCategoryLink reports whether a link to target puts the page in a
+// category rather than linking to it.
+func (wk *wiki) isCategoryLink(target string) bool {
+	if strings.HasPrefix(target, ":") {
+		return false
+	}
+	namespaces := wk.namespaces()
+	ns, _ := namespaces.split(namespaces.normalize(target))
+	return ns == nsCategory
+}
+
+func (wk *wiki) categoryIndexPath() string {
+	return strings.TrimSuffix(wk.indexCachePath(), ".idx") + ".cat.idx"
+}
+
+// loadCategoryIndex loads the category index, building it first if
+// -categories is set and it's missing or out of date.
+func (wk *wiki) loadCategoryIndex() error {
+	idx, err := wk.loadKeyIndex("category", wk.categoryIndexPath(), categoryIndexMagic, *categories, func(p page, entry indexEntry) []string {
+		if p.isRedirect() {
+			return nil
+		}
+		var keys []string
+		section := categorySection(entry.ns)
+		for _, c := range wk.pageCategories(p) {
+			keys = append(keys, categoryKey(c.title, section, c.sortKey, p.Title))
+		}
+		return keys
+	})
+	if err != nil || idx == nil {
+		return err
+	}
+
+	wk.updateSnapshot(func(s *snapshot) {
+		s.categories = &categoryIndex{*idx}
+	})
+	return nil
+}
+
+// categoryGroup is a run of members whose sort keys start with the same
+// letter.
+type categoryGroup struct {
+	Letter  string
+	Members []link
+}
+
+type categoryListSection struct {
+	Title      string
+	Total      int
+	Groups     []categoryGroup
+	Prev, Next string
+}
+
+// categoryListing is the list of members shown on a category page.
+type categoryListing struct {
+	// Unavailable is set if the category index hasn't been built.
+	Unavailable bool
+	Sections    []categoryListSection
+}
+
+// categoryListing lists the members of the category title for the page
+// requested by r.
+func (wk *wiki) categoryListing(title string, r *http.Request) *categoryListing {
+	idx := wk.categories()
+	if idx == nil {
+		return &categoryListing{Unavailable: true}
+	}
+	var listing categoryListing
+	for section, param := range sectionParams {
+		lo, hi := idx.sectionSpan(title, section)
+		if lo == hi {
+			continue
+		}
+		start := lo
+		if from := r.FormValue(param); from != "" {
+			// Like MediaWiki the position is a sort key optionally followed
+			// by a newline and the title.
+			parts := strings.SplitN(from, "\n", 2)
+			key := sectionPrefix(title, section) + strings.ToUpper(parts[0])
+			if len(parts) > 1 {
+				key += "\x00" + parts[1]
+			}
+			start = idx.search(key)
+			if start < lo {
+				start = lo
+			}
+		}
+		end := start + categoryPageLimit
+		if end > hi {
+			end = hi
+		}
+
+		pageURL := func(i int) string {
+			q := r.URL.Query()
+			if i == lo {
+				q.Del(param)
+			} else {
+				sortKey, member := idx.member(i)
+				q.Set(param, sortKey+"\n"+member)
+			}
+			u := wk.articleURL(title)
+			if len(q) > 0 {
+				u += "?" + q.Encode()
+			}
+			return u
+		}
+
+		s := categoryListSection{
+			Title: sectionTitles[section],
+			Total: hi - lo,
+		}
+		for i := start; i < end; i++ {
+			sortKey, member := idx.member(i)
+			letter := " "
+			if r, _ := utf8.DecodeRuneInString(sortKey); r != utf8.RuneError {
+				letter = string(r)
+			}
+			if len(s.Groups) == 0 || s.Groups[len(s.Groups)-1].Letter != letter {
+				s.Groups = append(s.Groups, categoryGroup{Letter: letter})
+			}
+			g := &s.Groups[len(s.Groups)-1]
+			g.Members = append(g.Members, link{Title: member, URL: wk.articleURL(member)})
+		}
+		if start > lo {
+			prev := start - categoryPageLimit
+			if prev < lo {
+				prev = lo
+			}
+			s.Prev = pageURL(prev)
+		}
+		if end < hi {
+			s.Next = pageURL(end)
+		}
+		listing.Sections = append(listing.Sections, s)
+	}
+	return &listing
+}
+
+// hasMembers reports whether category has any members in the index.
+func (idx *categoryIndex) hasMembers(category string) bool {
+	lo, hi := idx.span(category + "\x00")
+	return lo < hi
+}
+
+// categoryTitle returns the title of the category name, which may leave out
+// the Category: prefix.
+func (wk *wiki) categoryTitle(name string) string {
+	namespaces := wk.namespaces()
+	title := namespaces.normalize(name)
+	if ns, _ := namespaces.split(title); ns != nsCategory {
+		title = namespaces.normalize(namespaces.prefix(nsCategory) + name)
+	}
+	return title
+}
+
+// handleRandomInCategory redirects to a random member of the category arg.
+func (wk *wiki) handleRandomInCategory(w http.ResponseWriter, r *http.Request, arg string) error {
+	idx := wk.categories()
+	if idx == nil {
+		return statusErrorf(http.StatusServiceUnavailable, "there is no category index, restart wikigopher with -categories to build one")
+	}
+	category := wk.categoryTitle(arg)
+	lo, hi := idx.span(category + "\x00")
+	if lo == hi {
+		return statusErrorf(http.StatusNotFound, "no pages in %q", category)
+	}
+	_, title := idx.member(lo + rand.Intn(hi-lo))
+	http.Redirect(w, r, wk.articleURL(title), http.StatusTemporaryRedirect)
+	return nil
+}
+
+// categoryLinks returns links to the categories p is in for the category
+// bar.
+func (wk *wiki) categoryLinks(p page) []link {
+	var links []link
+	for _, c := range wk.pageCategories(p) {
+		_, name := wk.namespaces().split(c.title)
+		links = append(links, link{Title: name, URL: wk.articleURL(c.title)})
+	}
+	return links
+}
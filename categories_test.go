@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCategoryIndex(t *testing.T) {
+	pages := []string{
+		testPage(1, "John Smith", "{{DEFAULTSORT:Smith, John}}[[Category:People]]"),
+		testPage(2, "Alice", "[[Category:People|Zed]] [[:Category:Linked]]"),
+		testPage(3, "Category:People", "[[Category:Things]]"),
+		testPage(4, "Category:Authors", "[[Category:People]]"),
+		testPage(5, "File:Bob.jpg", "[[category:people]]"),
+		testRedirect(6, "Redirect", "Alice", "#REDIRECT [[Alice]] [[Category:People]]"),
+		testPage(7, "Long", "[[Category:People|"+strings.Repeat("é", maxSortKeyLen)+"]]"),
+	}
+	for i := 0; i < categoryPageLimit+10; i++ {
+		pages = append(pages, testPage(100+i, fmt.Sprintf("Member %03d", i), "[[Category:Big]]"))
+	}
+
+	old := *categories
+	defer func() { *categories = old }()
+	*categories = true
+	// Write a run per stream to merge.
+	defer func(n int) { keyRunBytes = n }(keyRunBytes)
+	keyRunBytes = 1
+
+	wk, dir := writeTestDump(t, pages...)
+	defer os.RemoveAll(dir)
+	if err := wk.loadCategoryIndex(); err != nil {
+		t.Fatal(err)
+	}
+	built := wk.categories()
+	if built == nil {
+		t.Fatal("category index wasn't built")
+	}
+
+	// Loading again reads the index file.
+	*categories = false
+	wk.updateSnapshot(func(s *snapshot) {
+		s.categories = nil
+	})
+	if err := wk.loadCategoryIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if idx := wk.categories(); idx == nil || !reflect.DeepEqual(idx, built) {
+		t.Fatalf("loaded index doesn't match the built one")
+	}
+
+	members := func(section int) []string {
+		var titles []string
+		lo, hi := wk.categories().sectionSpan("Category:People", section)
+		for i := lo; i < hi; i++ {
+			_, title := wk.categories().member(i)
+			titles = append(titles, title)
+		}
+		return titles
+	}
+	if got, want := members(sectionSubcategories), []string{"Category:Authors"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subcategories = %q; not %q", got, want)
+	}
+	// The redirect isn't listed and pages are sorted by their sort keys.
+	if got, want := members(sectionPages), []string{"John Smith", "Alice", "Long"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pages = %q; not %q", got, want)
+	}
+	lo, _ := wk.categories().sectionSpan("Category:People", sectionPages)
+	if sortKey, _ := wk.categories().member(lo + 2); sortKey != strings.Repeat("É", (maxSortKeyLen-1)/2) {
+		t.Errorf("long sort key kept as %q", sortKey)
+	}
+	if got, want := members(sectionFiles), []string{"File:Bob.jpg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %q; not %q", got, want)
+	}
+	if wk.categories().hasMembers("Category:Linked") {
+		t.Errorf("[[:Category:Linked]] shouldn't add a member")
+	}
+
+	r := httptest.NewRequest("GET", "/wiki/Category:Big", nil)
+	listing := wk.categoryListing("Category:Big", r)
+	if len(listing.Sections) != 1 {
+		t.Fatalf("got %d sections; not 1", len(listing.Sections))
+	}
+	s := listing.Sections[0]
+	if s.Total != categoryPageLimit+10 || s.Next == "" || s.Prev != "" {
+		t.Fatalf("got total %d, next %q, prev %q", s.Total, s.Next, s.Prev)
+	}
+	r = httptest.NewRequest("GET", s.Next, nil)
+	s = wk.categoryListing("Category:Big", r).Sections[0]
+	if len(s.Groups) != 1 || len(s.Groups[0].Members) != 10 || s.Groups[0].Members[0].Title != fmt.Sprintf("Member %03d", categoryPageLimit) {
+		t.Errorf("second page got %+v", s.Groups)
+	}
+	if s.Next != "" || s.Prev == "" {
+		t.Errorf("second page got next %q, prev %q", s.Next, s.Prev)
+	}
+
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := wk.handleArticle(w, httptest.NewRequest("GET", "/wiki/Alice", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `<div class="catlinks">`) || strings.Count(body, "Category:People") != 1 {
+		t.Errorf("category link should only be in the category bar: %s", body)
+	}
+	// Category:Big has no page but still lists its members.
+	w = httptest.NewRecorder()
+	if err := wk.handleArticle(w, httptest.NewRequest("GET", "/wiki/Category:Big", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, ">Member 000<") {
+		t.Errorf("Category:Big doesn't list its members: %s", body)
+	}
+}
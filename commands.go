@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/d4l3k/wikigopher/wikitext"
+	"github.com/pkg/errors"
+)
+
+// command is a subcommand of wikigopher, given after the flags. Flags may
+// also be given after the command.
+type command struct {
+	name, args, help string
+	run              func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "", "run the HTTP server, the default", serveCommand},
+	{"get", "<title>", "print the wikitext of a page", getCommand},
+	{"render", "<title|file|->", "print a page, a file or stdin rendered as HTML", renderCommand},
+	{"index", "", "build the indexes enabled by the flags and exit", indexCommand},
+	{"build", "", "render every article to a static site in -out", buildCommand},
+	{"verify", "", "check every page in the dump against its SHA-1", verifyCommand},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command] [args]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-22s %s\n", strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// usageError is returned for bad command lines. wikigopher prints the usage
+// and exits with status 2 for them.
+type usageError struct {
+	error
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return usageError{errors.Errorf(format, args...)}
+}
+
+// commandWiki returns the wiki the get and render commands read from, the
+// first one given.
+func commandWiki() (*wiki, error) {
+	wk := wikis[0]
+	wk.cache = newStreamCache(int64(*cacheSize) << 20)
+	if err := wk.loadTitles(); err != nil {
+		return nil, err
+	}
+	return wk, nil
+}
+
+// getCommand prints the wikitext of the page given by title.
+func getCommand(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("get takes one title")
+	}
+	wk, err := commandWiki()
+	if err != nil {
+		return err
+	}
+	entry, err := wk.fetchArticle(args[0])
+	if err != nil {
+		return err
+	}
+	p, err := wk.readArticle(entry)
+	if err != nil {
+		return err
+	}
+	text := p.Text
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	_, err = io.WriteString(os.Stdout, text)
+	return err
+}
+
+// renderCommand prints the HTML of a page. The argument is read as wikitext
+// from stdin if it's "-", from the file if there's one with that name and
+// otherwise it's looked up as a title. Templates are read from the dump.
+func renderCommand(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("render takes one title, file or -")
+	}
+	wk, err := commandWiki()
+	if err != nil {
+		return err
+	}
+
+	var p page
+	switch name := args[0]; {
+	case name == "-":
+		text, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		p = page{Title: "-", Text: string(text)}
+	case isFile(name):
+		text, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		title := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		p = page{Title: wikitext.URLToTitle(title), Text: string(text)}
+	default:
+		if p, err = wk.fetchPage(name); err != nil {
+			return err
+		}
+	}
+
+	body, err := wk.renderPage(p)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", body)
+	return err
+}
+
+func isFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// indexCommand builds the title index and whichever of the search, category
+// and backlink indexes are enabled, then exits.
+func indexCommand(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("index takes no arguments")
+	}
+	for _, wk := range wikis {
+		wk.cache = newStreamCache(int64(*cacheSize) << 20)
+		if err := wk.loadIndex(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
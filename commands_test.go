@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// captureStdout returns what f writes to stdout.
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+
+	out := make(chan string)
+	go func() {
+		buf, _ := ioutil.ReadAll(r)
+		out <- string(buf)
+	}()
+	err = f()
+	w.Close()
+	return <-out, err
+}
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := wikis
+	defer func() { wikis = old }()
+	wk := newWiki("", testDump, "")
+	wk.indexCacheFile = filepath.Join(dir, "dump.xml.bz2.idx")
+	wikis = []*wiki{wk}
+
+	out, err := captureStdout(t, func() error { return getCommand([]string{"Template:Box_50"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := wk.fetchPage("Template:Box 50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != p.Text+"\n" {
+		t.Errorf("get printed %q; not %q", out, p.Text)
+	}
+
+	if _, err := captureStdout(t, func() error { return getCommand([]string{"No such page"}) }); !isNotFound(err) {
+		t.Errorf("get of a missing page returned %v", err)
+	}
+
+	file := filepath.Join(dir, "Test_page.wiki")
+	if err := ioutil.WriteFile(file, []byte("A [[link]]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = captureStdout(t, func() error { return renderCommand([]string{file}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `<a href="./link">link</a>`) {
+		t.Errorf("render printed %q", out)
+	}
+
+	for _, args := range [][]string{nil, {"a", "b"}} {
+		if err := getCommand(args); err == nil {
+			t.Errorf("get %q succeeded", args)
+		} else if _, ok := errors.Cause(err).(usageError); !ok {
+			t.Errorf("get %q returned %v; not a usage error", args, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// streams returns the offsets of every stream in the articles file in order.
+func (idx *titleIndex) streams() []int {
+	return append([]int(nil), idx.offsets...)
+}
+
+// streamsAfter returns the streams with offsets greater than seek.
+func streamsAfter(streams []int, seek int) []int {
+	return streams[sort.SearchInts(streams, seek+1):]
+}
+
+type crawlResult struct {
+	i   int
+	err error
+}
+
+// walkStreams decodes every stream in streams using the given number of
+// workers and calls fn with its pages. Streams are read directly rather than
+// through the wiki's cache so a crawl doesn't evict pages being viewed.
+//
+// checkpoint is called in order with the offset of each stream once it and
+// every stream before it have been processed, so a crawl can be resumed from
+// the last checkpoint. Streams that fail to decode are logged and skipped.
+func (wk *wiki) walkStreams(streams []int, workers int, fn func(seek int, pages []page) error, checkpoint func(seek int) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	results := make(chan crawlResult)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		defer close(jobs)
+		for i := range streams {
+			select {
+			case jobs <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				var err error
+				seek := streams[i]
+				if pages, readErr := wk.readStream(seek); readErr != nil {
+					log.Printf("skipping stream at %d: %+v", seek, readErr)
+				} else {
+					err = fn(seek, pages)
+				}
+				select {
+				case results <- crawlResult{i: i, err: err}:
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+
+	done := make([]bool, len(streams))
+	next := 0
+	for range streams {
+		res := <-results
+		if res.err != nil {
+			return res.err
+		}
+		done[res.i] = true
+		if !done[next] {
+			continue
+		}
+		for next < len(streams) && done[next] {
+			next++
+		}
+		if err := checkpoint(streams[next-1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
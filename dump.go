@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	pbzip2 "github.com/d4l3k/go-pbzip2"
+	"github.com/pkg/errors"
+)
+
+// dumpFormat is how the articles dump is stored, which determines what the
+// offsets in the title index refer to.
+type dumpFormat int
+
+const (
+	// formatMultistream is a multistream bz2 dump with the index from
+	// dumps.wikimedia.org. Offsets are the byte offsets of streams.
+	formatMultistream dumpFormat = iota
+	// formatBZ2 is a bz2 dump without an index. Offsets are the bit offsets
+	// of the bzip2 blocks pages start in.
+	formatBZ2
+	// formatXML is an uncompressed dump. Offsets are the byte offsets of
+	// pages.
+	formatXML
+	// formatGzip is a gzipped dump. Gzip can't be read from the middle so
+	// pages are copied to a separate file of gzip members holding
+	// pagesPerStream pages each. Offsets are the byte offsets of the members.
+	formatGzip
+)
+
+// pagesPerStream is the number of pages in each gzip member written for
+// formatGzip, the same as in the multistream dumps.
+const pagesPerStream = 100
+
+func (wk *wiki) detectFormat() dumpFormat {
+	format := detectFormat(wk.articlesFile)
+	if format == formatBZ2 && wk.indexFile != "" {
+		if _, err := os.Stat(wk.indexFile); err == nil {
+			return formatMultistream
+		}
+	}
+	return format
+}
+
+// detectFormat returns the format of the dump at path assuming it doesn't
+// have a multistream index.
+func detectFormat(path string) dumpFormat {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return formatGzip
+	case strings.HasSuffix(path, ".bz2"):
+		return formatBZ2
+	}
+	return formatXML
+}
+
+// titleSource returns the file the title index is built from: the multistream
+// index or, if there isn't one, the articles dump itself.
+func (wk *wiki) titleSource() string {
+	if wk.format == formatMultistream {
+		return wk.indexFile
+	}
+	return wk.articlesFile
+}
+
+// gzipStreamsPath returns the path of the file pages from the gzipped dump at
+// path are copied to.
+func gzipStreamsPath(path string) string {
+	return path + ".streams"
+}
+
+// openDump returns a reader of the decompressed XML in f.
+func openDump(f *os.File) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(f.Name(), ".gz"):
+		return gzip.NewReader(bufio.NewReader(f))
+	case strings.HasSuffix(f.Name(), ".bz2"):
+		return bzip2.NewReader(bufio.NewReader(f)), nil
+	}
+	return bufio.NewReader(f), nil
+}
+
+// readTitles calls f for every title in the dump.
+func (wk *wiki) readTitles(f func(title string, entry indexEntry) error) error {
+	if wk.format == formatMultistream {
+		return wk.readBZ2Index(wk.indexFile, f)
+	}
+	return wk.scanDump(wk.articlesFile, wk.format, f)
+}
+
+// scanDump reads every page in the dump at path and calls f with its title
+// and location. It's used instead of the multistream index for other kinds of
+// dumps.
+func (wk *wiki) scanDump(path string, format dumpFormat, f func(title string, entry indexEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	log.Printf("Scanning %q for pages...", path)
+	wk.status.setPhase("Scanning articles", 0)
+
+	switch format {
+	case formatBZ2:
+		blocks := &bz2BlockSplitter{blocks: newBZ2BlockReader(file)}
+		return wk.scanPages(blocks, func(title string, id int, start, end int64) error {
+			return f(title, indexEntry{id: id, seek: blocks.seek(start)})
+		})
+
+	case formatGzip:
+		zr, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			return err
+		}
+		w, err := newGzipStreamWriter(gzipStreamsPath(path))
+		if err != nil {
+			return err
+		}
+		defer w.abort()
+		rec := &recordingReader{r: bufio.NewReader(zr)}
+		if err := wk.scanPages(rec, func(title string, id int, start, end int64) error {
+			seek, err := w.write(rec.take(start, end))
+			if err != nil {
+				return err
+			}
+			return f(title, indexEntry{id: id, seek: seek})
+		}); err != nil {
+			return err
+		}
+		return w.close()
+
+	default:
+		return wk.scanPages(bufio.NewReader(file), func(title string, id int, start, end int64) error {
+			return f(title, indexEntry{id: id, seek: int(start)})
+		})
+	}
+}
+
+// scanPages decodes every page in r and calls f with its title, ID and the
+// offsets of its start and end in r.
+func (wk *wiki) scanPages(r io.Reader, f func(title string, id int, start, end int64) error) error {
+	d := xml.NewDecoder(r)
+	i := 0
+	for {
+		start := d.InputOffset()
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		elem, ok := tok.(xml.StartElement)
+		if !ok || elem.Name.Local != "page" {
+			continue
+		}
+		var p struct {
+			Title string `xml:"title"`
+			ID    int    `xml:"id"`
+		}
+		if err := d.DecodeElement(&p, &elem); err != nil {
+			return errors.Wrapf(err, "decoding page at %d", start)
+		}
+		if err := f(p.Title, p.ID, start, d.InputOffset()); err != nil {
+			return err
+		}
+
+		i++
+		if i%100000 == 0 {
+			log.Printf("scanned %d pages", i)
+			wk.status.setEntries(i)
+		}
+	}
+	log.Printf("Done scanning %d pages!", i)
+	return nil
+}
+
+// openFile returns the shared handle of the file at path, opening it the first
+// time. It's only read with ReadAt so concurrent reads don't interfere.
+func (wk *wiki) openFile(path string) (*os.File, error) {
+	wk.filesMu.Lock()
+	defer wk.filesMu.Unlock()
+
+	if f, ok := wk.files[path]; ok {
+		return f, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if wk.files == nil {
+		wk.files = map[string]*os.File{}
+	}
+	wk.files[path] = f
+	return f, nil
+}
+
+// openStream returns a reader of the XML of the pages at seek in s, which must
+// be closed once done. bzip2 streams are decompressed in parallel.
+func (wk *wiki) openStream(s *snapshot, seek int) (io.Reader, io.Closer, error) {
+	path, format := wk.articlesFile, wk.format
+	end, hasEnd := s.titles.streamEnd(seek)
+	if i := seek >> incrementalShift; i > 0 {
+		path, format = s.incremental[i-1].path, s.incremental[i-1].format
+		seek &= 1<<incrementalShift - 1
+		end &= 1<<incrementalShift - 1
+	}
+	if format == formatGzip {
+		path = gzipStreamsPath(path)
+	}
+	f, err := wk.openFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	offset := int64(seek)
+	if format == formatBZ2 {
+		offset /= 8
+	}
+	n := int64(math.MaxInt64) - offset
+	if hasEnd {
+		n = int64(end) - offset
+		if format == formatBZ2 {
+			// The last page runs on into the block the next stream starts
+			// in, so that block is read too.
+			n = int64(end)/8 + bz2MaxBlockBytes - offset
+		}
+	}
+	section := io.NewSectionReader(f, offset, n)
+
+	switch format {
+	case formatMultistream:
+		r, err := pbzip2.NewReader(section)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, r, nil
+
+	case formatBZ2:
+		blocks := newBZ2BlockReader(section)
+		if hasEnd {
+			blocks.lastBlock = int64(end) - offset*8
+			blocks.hasLastBlock = true
+		}
+		bz, err := pbzip2.NewReader(blocks)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The block starts in the middle of a page.
+		r, err := skipToPage(bufio.NewReader(bz))
+		if err != nil {
+			bz.Close()
+			return nil, nil, errors.Wrapf(err, "finding the first page in block at bit %d", seek)
+		}
+		return r, bz, nil
+
+	case formatGzip:
+		r, err := gzip.NewReader(bufio.NewReader(section))
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, r, nil
+	}
+	r := bufio.NewReader(section)
+	return r, ioutil.NopCloser(r), nil
+}
+
+// skipToPage discards everything in r before the first <page> tag.
+func skipToPage(r *bufio.Reader) (io.Reader, error) {
+	const tag = "<page>"
+	for {
+		if _, err := r.ReadSlice('<'); err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		next, err := r.Peek(len(tag) - 1)
+		if err != nil {
+			return nil, err
+		}
+		if string(next) == tag[1:] {
+			return io.MultiReader(strings.NewReader("<"), r), nil
+		}
+	}
+}
+
+// bz2BlockSplitter decompresses a bzip2 file one block at a time, recording
+// the decompressed offset each block starts at.
+type bz2BlockSplitter struct {
+	blocks *bz2BlockReader
+	buf    []byte
+	offset int64
+	// starts and bits are the decompressed offsets and bit offsets in the
+	// file of each block read so far.
+	starts, bits []int64
+}
+
+func (s *bz2BlockSplitter) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		stream, bit, err := s.blocks.next()
+		if err != nil {
+			return 0, err
+		}
+		data, err := ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(stream)))
+		if err != nil {
+			return 0, errors.Wrapf(err, "decoding block at bit %d", bit)
+		}
+		s.starts = append(s.starts, s.offset)
+		s.bits = append(s.bits, bit)
+		s.offset += int64(len(data))
+		s.buf = data
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// seek returns the bit offset of the block the decompressed offset is in.
+func (s *bz2BlockSplitter) seek(offset int64) int {
+	i := sort.Search(len(s.starts), func(i int) bool {
+		return s.starts[i] > offset
+	})
+	return int(s.bits[i-1])
+}
+
+// recordingReader keeps the bytes read from it until they're taken. It
+// implements io.ByteReader so xml.Decoder doesn't read ahead of the offsets it
+// reports.
+type recordingReader struct {
+	r   *bufio.Reader
+	buf []byte
+	// start is the offset of buf[0].
+	start int64
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+func (r *recordingReader) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err == nil {
+		r.buf = append(r.buf, c)
+	}
+	return c, err
+}
+
+// take returns the bytes read between the offsets start and end and discards
+// everything before end.
+func (r *recordingReader) take(start, end int64) []byte {
+	b := r.buf[start-r.start : end-r.start]
+	r.buf = r.buf[end-r.start:]
+	r.start = end
+	return b
+}
+
+// gzipStreamWriter copies pages to a file of gzip members holding
+// pagesPerStream pages each. The file is written to a temporary location until
+// it's closed.
+type gzipStreamWriter struct {
+	path string
+	f    *os.File
+	w    countingWriter
+	zw   *gzip.Writer
+	// offset is the offset of the current member.
+	offset int
+	pages  int
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += n
+	return n, err
+}
+
+func newGzipStreamWriter(path string) (*gzipStreamWriter, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &gzipStreamWriter{
+		path: path,
+		f:    f,
+		w:    countingWriter{w: bufio.NewWriter(f)},
+	}, nil
+}
+
+// write adds a page and returns the offset of the member it's in.
+func (w *gzipStreamWriter) write(page []byte) (int, error) {
+	if w.zw == nil {
+		w.offset = w.w.n
+		w.zw = gzip.NewWriter(&w.w)
+	}
+	if _, err := w.zw.Write(page); err != nil {
+		return 0, err
+	}
+	if _, err := w.zw.Write([]byte("\n")); err != nil {
+		return 0, err
+	}
+	offset := w.offset
+	w.pages++
+	if w.pages%pagesPerStream == 0 {
+		if err := w.zw.Close(); err != nil {
+			return 0, err
+		}
+		w.zw = nil
+	}
+	return offset, nil
+}
+
+func (w *gzipStreamWriter) close() error {
+	if w.zw != nil {
+		if err := w.zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := w.w.w.Flush(); err != nil {
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.f.Name(), w.path)
+}
+
+// abort removes the temporary file if close wasn't called or failed.
+func (w *gzipStreamWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
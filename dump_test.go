@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testdata/dump.xml.bz2 is a single stream dump of 300 pages compressed with
+// 100k blocks so it's split over 3 blocks.
+const testDump = "testdata/dump.xml.bz2"
+
+// testDumpHeader is the start of the dumps written by writeTestDump, up to
+// the first page.
+const testDumpHeader = `<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" version="0.10" xml:lang="en">
+  <siteinfo>
+    <sitename>Wikipedia</sitename>
+    <dbname>testwiki</dbname>
+    <namespaces>
+      <namespace key="0" case="first-letter" />
+      <namespace key="6" case="first-letter">File</namespace>
+      <namespace key="10" case="first-letter">Template</namespace>
+      <namespace key="14" case="first-letter">Category</namespace>
+      <namespace key="828" case="first-letter">Module</namespace>
+    </namespaces>
+  </siteinfo>
+`
+
+// testPage returns a <page> for writeTestDump.
+func testPage(id int, title, text string) string {
+	return fmt.Sprintf(`  <page>
+    <title>%s</title>
+    <id>%d</id>
+    <revision>
+      <text xml:space="preserve">%s</text>
+    </revision>
+  </page>
+`, title, id, text)
+}
+
+// testRedirect returns a <page> for writeTestDump that redirects to target.
+func testRedirect(id int, title, target, text string) string {
+	return strings.Replace(testPage(id, title, text), "<revision>", fmt.Sprintf(`<redirect title="%s" />
+    <revision>`, target), 1)
+}
+
+// writeTestDump writes an uncompressed dump of pages to a new temporary
+// directory and returns a wiki with its titles loaded along with the
+// directory, which should be removed when done.
+func writeTestDump(t *testing.T, pages ...string) (*wiki, string) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "dump.xml")
+	if err := ioutil.WriteFile(path, []byte(testDumpHeader+strings.Join(pages, "")+"</mediawiki>\n"), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	wk := newWiki("", path, "")
+	wk.cache = newStreamCache(1 << 20)
+	if err := wk.loadTitles(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return wk, dir
+}
+
+func readTestDump(t *testing.T) []byte {
+	f, err := os.Open(testDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(bzip2.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBZ2BlockReader(t *testing.T) {
+	want := readTestDump(t)
+	f, err := os.Open(testDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Rewriting every block as its own stream shouldn't change the output.
+	got, err := ioutil.ReadAll(bzip2.NewReader(newBZ2BlockReader(f)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes; not %d", len(got), len(want))
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	blocks := &bz2BlockSplitter{blocks: newBZ2BlockReader(f)}
+	if _, err := ioutil.ReadAll(blocks); err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks.bits) != 3 {
+		t.Fatalf("found %d blocks; not 3", len(blocks.bits))
+	}
+
+	// Reading from the middle of the file gives the rest of the output.
+	last := len(blocks.bits) - 1
+	if _, err := f.Seek(blocks.bits[last]/8, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(bzip2.NewReader(newBZ2BlockReader(f)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[blocks.starts[last]:]) {
+		t.Errorf("reading from the last block got %d bytes; not %d", len(got), len(want)-int(blocks.starts[last]))
+	}
+
+	// Reading stops after the last block asked for.
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	r := newBZ2BlockReader(f)
+	r.lastBlock = blocks.bits[1]
+	r.hasLastBlock = true
+	got, err = ioutil.ReadAll(bzip2.NewReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[:blocks.starts[2]]) {
+		t.Errorf("reading up to the second block got %d bytes; not %d", len(got), blocks.starts[2])
+	}
+}
+
+func TestScanDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := readTestDump(t)
+	xmlPath := filepath.Join(dir, "dump.xml")
+	if err := ioutil.WriteFile(xmlPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gzPath := filepath.Join(dir, "dump.xml.gz")
+	if err := ioutil.WriteFile(gzPath, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path   string
+		format dumpFormat
+	}{
+		{testDump, formatBZ2},
+		{xmlPath, formatXML},
+		{gzPath, formatGzip},
+	}
+	for _, c := range cases {
+		wk := newWiki("", c.path, "")
+		wk.indexCacheFile = filepath.Join(dir, filepath.Base(c.path)+".idx")
+		wk.cache = newStreamCache(1 << 20)
+		wk.format = wk.detectFormat()
+		if wk.format != c.format {
+			t.Errorf("%s: detected format %d; not %d", c.path, wk.format, c.format)
+			continue
+		}
+		if err := wk.loadSiteInfo(); err != nil {
+			t.Fatal(err)
+		}
+		if err := wk.loadTitleIndex(); err != nil {
+			t.Fatal(err)
+		}
+		if n := wk.titles().len(); n != 300 {
+			t.Errorf("%s: indexed %d titles; not 300", c.path, n)
+		}
+
+		for _, id := range []int{1, 50, 150, 299, 300} {
+			title := fmt.Sprintf("Page %d", id)
+			ns := nsMain
+			if id%50 == 0 {
+				title = fmt.Sprintf("Template:Box %d", id)
+				ns = nsTemplate
+			}
+			meta, err := wk.fetchArticle(title)
+			if err != nil {
+				t.Errorf("%s: %+v", c.path, err)
+				continue
+			}
+			if meta.ns != ns {
+				t.Errorf("%s: %q in namespace %d; not %d", c.path, title, meta.ns, ns)
+			}
+			p, err := wk.readArticle(meta)
+			if err != nil {
+				t.Errorf("%s: reading %q: %+v", c.path, title, err)
+				continue
+			}
+			if p.ID != id || p.Title != title {
+				t.Errorf("%s: read %d %q; not %d %q", c.path, p.ID, p.Title, id, title)
+			}
+		}
+	}
+}
+
+func TestReadArticleStopsAtPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wk := loadTestWiki(t, dir)
+
+	first, err := wk.fetchArticle("Page 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Find the last page of the same stream.
+	last := first
+	titles := wk.titles()
+	for i := 0; i < titles.len(); i++ {
+		if entry := titles.entry(i); entry.seek == first.seek && entry.id > last.id {
+			last = entry
+		}
+	}
+	size := titles.streamSize(first.seek)
+	if last.id == first.id || size < 2 {
+		t.Fatalf("stream at %d has %d pages", first.seek, size)
+	}
+
+	if _, err := wk.readArticle(first); err != nil {
+		t.Fatal(err)
+	}
+	pages, err := wk.cache.get(streamKey{titles: wk.titles(), seek: first.seek}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) >= size {
+		t.Errorf("reading page %d decoded %d pages of %d", first.id, len(pages), size)
+	}
+
+	p, err := wk.readArticle(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != last.id {
+		t.Errorf("read page %d; not %d", p.ID, last.id)
+	}
+	if len(wk.files) != 1 {
+		t.Errorf("opened %d files; not 1", len(wk.files))
+	}
+}
+
+func TestReadArticleConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wk := loadTestWiki(t, dir)
+
+	// Two pages from the start and middle of the same stream.
+	first, err := wk.fetchArticle("Page 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []indexEntry
+	titles := wk.titles()
+	for i := 0; i < titles.len(); i++ {
+		if entry := titles.entry(i); entry.seek == first.seek {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	middle := entries[len(entries)/2]
+
+	// Reads of the first page keep caching part of the stream while the
+	// reads of the middle one miss.
+	for i := 0; i < 20; i++ {
+		wk.cache = newStreamCache(1 << 20)
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			entry := first
+			if j%2 == 1 {
+				entry = middle
+			}
+			wg.Add(1)
+			go func(entry indexEntry) {
+				defer wg.Done()
+				for k := 0; k < 5; k++ {
+					if k%2 == 0 && entry == first {
+						wk.cache.drop(streamKey{titles: wk.titles(), seek: entry.seek})
+					}
+					if p, err := wk.readArticle(entry); err != nil {
+						t.Errorf("reading page %d: %+v", entry.id, err)
+						return
+					} else if p.ID != entry.id {
+						t.Errorf("read page %d; not %d", p.ID, entry.id)
+					}
+				}
+			}(entry)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/d4l3k/wikigopher/wikitext"
+	"github.com/pkg/errors"
+)
+
+// maxExportPages is the most pages Special:Export will export at once.
+const maxExportPages = 5000
+
+// readDumpHeader returns the start of the dump at path up to its first page:
+// the <mediawiki> element and the <siteinfo> block.
+func readDumpHeader(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r, err := openDump(f)
+	if err != nil {
+		return "", err
+	}
+	br := bufio.NewReader(r)
+	var header strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if i := strings.Index(line, "<page>"); i >= 0 {
+			header.WriteString(strings.TrimRight(line[:i], " \t"))
+			break
+		}
+		if err == io.EOF {
+			// A dump without any pages.
+			s := header.String() + line
+			if i := strings.LastIndex(s, "</mediawiki>"); i >= 0 {
+				s = s[:i]
+			}
+			header.Reset()
+			header.WriteString(s)
+			break
+		} else if err != nil {
+			return "", err
+		}
+		header.WriteString(line)
+	}
+	if !strings.Contains(header.String(), "<mediawiki") {
+		return "", errors.Errorf("no <mediawiki> element at the start of %q", path)
+	}
+	return header.String(), nil
+}
+
+// exportPage is a page in the MediaWiki export format. Unlike page the
+// elements are in the order the schema requires and missing ones are left
+// out.
+type exportPage struct {
+	XMLName      xml.Name       `xml:"page"`
+	Title        string         `xml:"title"`
+	NS           int            `xml:"ns"`
+	ID           int            `xml:"id"`
+	Redirect     []redirect     `xml:"redirect"`
+	Restrictions string         `xml:"restrictions,omitempty"`
+	Revision     exportRevision `xml:"revision"`
+}
+
+type exportRevision struct {
+	ID          string            `xml:"id"`
+	ParentID    string            `xml:"parentid,omitempty"`
+	Timestamp   string            `xml:"timestamp,omitempty"`
+	Contributor exportContributor `xml:"contributor"`
+	Minor       *struct{}         `xml:"minor"`
+	Comment     string            `xml:"comment,omitempty"`
+	Model       string            `xml:"model,omitempty"`
+	Format      string            `xml:"format,omitempty"`
+	Text        exportText        `xml:"text"`
+	SHA1        string            `xml:"sha1"`
+}
+
+type exportContributor struct {
+	Username string `xml:"username,omitempty"`
+	ID       string `xml:"id,omitempty"`
+	IP       string `xml:"ip,omitempty"`
+}
+
+type exportText struct {
+	Bytes int    `xml:"bytes,attr"`
+	Space string `xml:"xml:space,attr"`
+	// Text is escaped by textEscaper since encoding/xml would escape every
+	// newline too.
+	Text string `xml:",innerxml"`
+}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#13;")
+
+func newExportPage(p page) exportPage {
+	sha1 := p.SHA1
+	if sha1 == "" {
+		sha1 = sha1Base36(p.Text)
+	}
+	return exportPage{
+		Title:        p.Title,
+		NS:           p.NS,
+		ID:           p.ID,
+		Redirect:     p.Redirect,
+		Restrictions: p.Restrictions,
+		Revision: exportRevision{
+			ID:        p.RevisionID,
+			ParentID:  p.ParentID,
+			Timestamp: p.Timestamp,
+			Contributor: exportContributor{
+				Username: p.Username,
+				ID:       p.UserID,
+				IP:       p.IP,
+			},
+			Minor:   p.Minor,
+			Comment: p.Comment,
+			Model:   p.Model,
+			Format:  p.Format,
+			Text: exportText{
+				Bytes: len(p.Text),
+				Space: "preserve",
+				Text:  textEscaper.Replace(p.Text),
+			},
+			SHA1: sha1,
+		},
+	}
+}
+
+// writeExport writes pages as a MediaWiki export with the dump's own header
+// so it can be imported with Special:Import or importDump.php.
+func (wk *wiki) writeExport(w io.Writer, pages []page) error {
+	header, err := readDumpHeader(wk.articlesFile)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("  ", "  ")
+	for _, p := range pages {
+		if err := e.Encode(newExportPage(p)); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "</mediawiki>\n")
+	return err
+}
+
+// requireRegexp matches the modules loaded by a Lua module.
+var requireRegexp = regexp.MustCompile(`(?:require|mw\.loadData)\s*\(?\s*["']([^"']+)["']`)
+
+// pageDependencies returns the titles of the templates and modules p uses.
+func (wk *wiki) pageDependencies(p page) []string {
+	namespaces := wk.namespaces()
+	var titles []string
+	if ns, _ := namespaces.split(p.Title); ns == nsModule {
+		for _, m := range requireRegexp.FindAllStringSubmatch(p.Text, -1) {
+			if ns, _ := namespaces.split(m[1]); ns == nsModule {
+				titles = append(titles, namespaces.normalize(m[1]))
+			}
+		}
+		return titles
+	}
+	text := []byte(p.Text)
+	for _, name := range wikitext.Templates(text) {
+		titles = append(titles, wk.templateTitle(name))
+	}
+	for _, name := range wikitext.Modules(text) {
+		titles = append(titles, namespaces.normalize(namespaces.prefix(nsModule)+name))
+	}
+	return titles
+}
+
+// exportPages reads the pages with the given titles and the members of
+// category. If templates is set the templates and modules they use are added
+// too, recursively. Titles that don't exist are skipped.
+func (wk *wiki) exportPages(titles []string, category string, templates bool) ([]page, error) {
+	namespaces := wk.namespaces()
+	if category != "" {
+		idx := wk.categories()
+		if idx == nil {
+			return nil, statusErrorf(http.StatusServiceUnavailable, "there is no category index, restart wikigopher with -categories to build one")
+		}
+		lo, hi := idx.span(wk.categoryTitle(category) + "\x00")
+		for i := lo; i < hi; i++ {
+			_, title := idx.member(i)
+			titles = append(titles, title)
+		}
+	}
+
+	var pages []page
+	seen := map[string]bool{}
+	for len(titles) > 0 {
+		title := namespaces.normalize(titles[0])
+		titles = titles[1:]
+		if title == "" || seen[title] {
+			continue
+		}
+		seen[title] = true
+
+		p, err := wk.fetchPage(title)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		seen[p.Title] = true
+		if len(pages) == maxExportPages {
+			return nil, statusErrorf(http.StatusBadRequest, "can't export more than %d pages at once", maxExportPages)
+		}
+		pages = append(pages, p)
+		if templates {
+			titles = append(titles, wk.pageDependencies(p)...)
+		}
+	}
+	return pages, nil
+}
+
+// handleExport serves Special:Export, which exports pages as MediaWiki XML.
+// The pages are given one per line in the pages parameter or as arg, and the
+// members of the category catname may be added. Without either it shows a
+// form to pick them.
+func (wk *wiki) handleExport(w http.ResponseWriter, r *http.Request, arg string) error {
+	var titles []string
+	if arg != "" {
+		titles = append(titles, arg)
+	}
+	for _, line := range strings.Split(r.FormValue("pages"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			titles = append(titles, line)
+		}
+	}
+	category := strings.TrimSpace(r.FormValue("catname"))
+	templates := r.FormValue("templates") == "1"
+
+	if len(titles) == 0 && category == "" {
+		return executeTemplate(w, "export.html", struct {
+			pageData
+			Title, Action string
+			HasCategories bool
+		}{
+			pageData:      wk.pageData(),
+			Title:         "Export pages",
+			Action:        wk.articleURL(wk.namespaces().prefix(nsSpecial) + "Export"),
+			HasCategories: wk.categories() != nil,
+		})
+	}
+
+	pages, err := wk.exportPages(titles, category, templates)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	if r.FormValue("download") == "1" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+wk.siteInfo().DBName+`-export.xml"`)
+	}
+	return wk.writeExport(w, pages)
+}
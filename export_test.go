@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	edited := `  <page>
+    <title>Edited</title>
+    <ns>0</ns>
+    <id>1</id>
+    <restrictions>edit=sysop</restrictions>
+    <revision>
+      <id>101</id>
+      <parentid>100</parentid>
+      <timestamp>2018-04-03T20:38:02Z</timestamp>
+      <contributor>
+        <ip>127.0.0.1</ip>
+      </contributor>
+      <minor />
+      <comment>Fix &lt;typo&gt;</comment>
+      <model>wikitext</model>
+      <format>text/x-wiki</format>
+      <text xml:space="preserve">Line one
+Line &amp; two {{Box}} [[Category:Things]]</text>
+      <sha1>` + sha1Base36("Line one\nLine & two {{Box}} [[Category:Things]]") + `</sha1>
+    </revision>
+  </page>
+`
+	old := *categories
+	defer func() { *categories = old }()
+	*categories = true
+
+	wk, dir := writeTestDump(t,
+		edited,
+		testPage(2, "Template:Box", "{{#invoke:Box|main}} {{Missing}}"),
+		testPage(3, "Module:Box", `local data = mw.loadData("Module:Box/data") return require('Module:Util')`),
+		testPage(4, "Module:Box/data", "return {}"),
+		testPage(5, "Module:Util", "return {}"),
+		testPage(6, "Other", "[[Category:Things]]"),
+	)
+	defer os.RemoveAll(dir)
+	if err := wk.loadCategoryIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(form url.Values) (string, []page) {
+		r := httptest.NewRequest("POST", "/wiki/Special:Export", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		if err := wk.handleArticle(w, r); err != nil {
+			t.Fatalf("%v: %+v", form, err)
+		}
+		body := w.Body.String()
+		var dump struct {
+			Pages []page `xml:"page"`
+		}
+		if err := xml.Unmarshal([]byte(body), &dump); err != nil {
+			t.Fatalf("%v: %v: %s", form, err, body)
+		}
+		return body, dump.Pages
+	}
+	titles := func(pages []page) []string {
+		var titles []string
+		for _, p := range pages {
+			titles = append(titles, p.Title)
+		}
+		return titles
+	}
+
+	body, got := export(url.Values{"pages": {"Edited\nNo such page\nedited"}})
+	if !strings.HasPrefix(body, testDumpHeader) || !strings.HasSuffix(body, "</mediawiki>\n") {
+		t.Errorf("export doesn't have the dump's header and footer: %s", body)
+	}
+	want, err := wk.fetchPage("Edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 1 {
+		got[0].XMLName = want.XMLName
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Errorf("export decoded as %+v; not %+v", got, want)
+	}
+	if err := got[0].verify(); err != nil {
+		t.Error(err)
+	}
+	for _, s := range []string{`<text bytes="47" xml:space="preserve">Line one
+Line &amp; two`, "<minor></minor>", "<ip>127.0.0.1</ip>"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("export doesn't contain %s: %s", s, body)
+		}
+	}
+	if strings.Contains(body, "<username>") {
+		t.Errorf("export of an IP edit has a username: %s", body)
+	}
+
+	_, got = export(url.Values{"pages": {"Edited"}, "templates": {"1"}})
+	if got, want := titles(got), []string{"Edited", "Template:Box", "Module:Box", "Module:Box/data", "Module:Util"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("export with templates got %q; not %q", got, want)
+	}
+
+	_, got = export(url.Values{"catname": {"Things"}})
+	if got, want := titles(got), []string{"Edited", "Other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("export of category got %q; not %q", got, want)
+	}
+
+	// Without any pages it shows the form.
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := wk.handleArticle(w, httptest.NewRequest("GET", "/wiki/Special:Export", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte(`<textarea name="pages"`)) {
+		t.Errorf("got %s", w.Body)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// incrementalShift is where the number of the incremental dump a stream is in
+// is stored in its offset, so offsets are unique across files. Offsets in the
+// base dump are unchanged.
+const incrementalShift = 44
+
+// incrementalDump is an adds-changes dump from
+// https://dumps.wikimedia.org/other/incr/ applied on top of the base dump.
+type incrementalDump struct {
+	path   string
+	format dumpFormat
+	date   time.Time
+}
+
+var dumpDateRegexp = regexp.MustCompile(`-(\d{8})-`)
+
+// dumpDate returns when the dump at path was taken from its name, e.g.
+// enwiki-20180701-pages-meta-hist-incr.xml.bz2, or when it was modified if
+// the name doesn't include one. Names only have the day and the dump can
+// include changes from any time that day, so the end of the day is used.
+func dumpDate(path string) (time.Time, error) {
+	if m := dumpDateRegexp.FindStringSubmatch(filepath.Base(path)); m != nil {
+		t, err := time.Parse("20060102", m[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return t.AddDate(0, 0, 1), nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// findIncrementalDumps returns the page and logging dumps for the wiki in dir
+// in the order they should be applied. Files are matched by the wiki's
+// database name and sorted by name, which starts with the date of the dump.
+func findIncrementalDumps(dir, dbName string) (pages, logs []string, err error) {
+	var paths []string
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, dbName+"-") || strings.Contains(name, "stub") {
+			return nil
+		}
+		for _, ext := range []string{".xml", ".xml.bz2", ".xml.gz"} {
+			if strings.HasSuffix(name, ext) {
+				paths = append(paths, path)
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.Base(paths[i]) < filepath.Base(paths[j])
+	})
+	for _, path := range paths {
+		if strings.Contains(filepath.Base(path), "logging") {
+			logs = append(logs, path)
+		} else {
+			pages = append(pages, path)
+		}
+	}
+	return pages, logs, nil
+}
+
+// applyIncremental returns base updated with the incremental dumps in
+// -incremental along with the dumps and deletion logs that were applied.
+// Pages in newer dumps replace older ones with the same title or ID, and pages
+// deleted after the dump they're from are removed.
+func (wk *wiki) applyIncremental(base *titleIndex) (*titleIndex, []incrementalDump, []string, error) {
+	pages, logs, err := findIncrementalDumps(*incrementalDir, wk.siteInfo().DBName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(pages) == 0 && len(logs) == 0 {
+		log.Printf("No incremental dumps for %s in %q", wk.siteInfo().DBName, *incrementalDir)
+		return base, nil, nil, nil
+	}
+	baseDate, err := dumpDate(wk.articlesFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	type overlayEntry struct {
+		entry indexEntry
+		date  time.Time
+	}
+	overlay := map[string]overlayEntry{}
+	ids := map[int]string{}
+	streamSizes := make(map[int]int, len(base.offsets))
+	for i, seek := range base.offsets {
+		streamSizes[seek] = int(base.sizes[i])
+	}
+	var dumps []incrementalDump
+	for i, path := range pages {
+		if i+1 >= 1<<(63-incrementalShift) {
+			return nil, nil, nil, errors.Errorf("too many incremental dumps")
+		}
+		dump := incrementalDump{path: path, format: detectFormat(path)}
+		if dump.date, err = dumpDate(path); err != nil {
+			return nil, nil, nil, err
+		}
+		idx, err := wk.loadIndexFile(path+".idx", path, func(f func(title string, entry indexEntry) error) error {
+			return wk.scanDump(dump.path, dump.format, f)
+		})
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "loading incremental dump %q", path)
+		}
+		dumps = append(dumps, dump)
+
+		file := (i + 1) << incrementalShift
+		for j, seek := range idx.offsets {
+			streamSizes[file|seek] = int(idx.sizes[j])
+		}
+		// Titles are sorted stably so later revisions of a page in the same
+		// dump come last and win.
+		for j := 0; j < idx.len(); j++ {
+			title, entry := idx.titleAt(j)
+			entry.seek |= file
+			overlay[title] = overlayEntry{entry: entry, date: dump.date}
+			ids[entry.id] = title
+		}
+	}
+
+	deletions := map[string]time.Time{}
+	for _, path := range logs {
+		if err := wk.readDeletions(path, baseDate, deletions); err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "reading deletions from %q", path)
+		}
+	}
+	deleted := func(title string, date time.Time) bool {
+		t, ok := deletions[title]
+		return ok && t.After(date)
+	}
+
+	wk.status.setPhase("Applying incremental dumps", 0)
+	newTitles := make([]string, 0, len(overlay))
+	for title := range overlay {
+		newTitles = append(newTitles, title)
+	}
+	sort.Strings(newTitles)
+
+	titles := make([]string, 0, base.len()+len(newTitles))
+	entries := make([]indexEntry, 0, base.len()+len(newTitles))
+	removed := 0
+	for i, j := 0, 0; i < base.len() || j < len(newTitles); {
+		if j == len(newTitles) || (i < base.len() && base.title(i) < newTitles[j]) {
+			title, entry := base.titleAt(i)
+			i++
+			// Skip pages that have since been moved or deleted.
+			if moved, ok := ids[entry.id]; (ok && moved != title) || deleted(title, baseDate) {
+				removed++
+				continue
+			}
+			titles = append(titles, title)
+			entries = append(entries, entry)
+			continue
+		}
+		if i < base.len() && base.title(i) == newTitles[j] {
+			i++
+		}
+		title := newTitles[j]
+		j++
+		o := overlay[title]
+		// Skip pages that a later dump has under another title.
+		if ids[o.entry.id] != title || deleted(title, o.date) {
+			removed++
+			continue
+		}
+		titles = append(titles, title)
+		entries = append(entries, o.entry)
+	}
+	log.Printf("Applied %d incremental dumps: %d updated pages, %d removed", len(pages), len(newTitles), removed)
+
+	idx, err := newTitleIndex(titles, entries)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// The streams still hold every page so their sizes are kept from the
+	// original indexes.
+	idx.setStreamSizes(streamSizes)
+	return idx, dumps, logs, nil
+}
+
+// logItem is an entry in a pages-logging dump.
+type logItem struct {
+	Timestamp string `xml:"timestamp"`
+	Type      string `xml:"type"`
+	Action    string `xml:"action"`
+	Title     string `xml:"logtitle"`
+}
+
+// readDeletions records the time of the last deletion after since of each
+// title in the logging dump at path. Titles that were restored afterwards are
+// removed.
+func (wk *wiki) readDeletions(path string, since time.Time, deletions map[string]time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := openDump(f)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reading deletions from %q...", path)
+	wk.status.setPhase("Reading deletions", 0)
+	namespaces := wk.namespaces()
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "logitem" {
+			continue
+		}
+		var item logItem
+		if err := d.DecodeElement(&item, &start); err != nil {
+			return err
+		}
+		if item.Type != "delete" || (item.Action != "delete" && item.Action != "restore") {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, item.Timestamp)
+		if err != nil {
+			return errors.Wrapf(err, "parsing timestamp of %q", item.Title)
+		}
+		if !t.After(since) {
+			continue
+		}
+		title := namespaces.normalize(item.Title)
+		if item.Action == "delete" {
+			deletions[title] = t
+		} else {
+			delete(deletions, title)
+		}
+	}
+}
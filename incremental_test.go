@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testIncrementalDump = `<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/" version="0.10" xml:lang="en">
+  <page>
+    <title>Page 5</title>
+    <ns>0</ns>
+    <id>5</id>
+    <revision>
+      <id>2005</id>
+      <text xml:space="preserve">updated</text>
+    </revision>
+  </page>
+  <page>
+    <title>Moved Page</title>
+    <ns>0</ns>
+    <id>7</id>
+    <revision>
+      <id>2007</id>
+      <text xml:space="preserve">moved</text>
+    </revision>
+  </page>
+  <page>
+    <title>Page 9</title>
+    <ns>0</ns>
+    <id>9</id>
+    <revision>
+      <id>2009</id>
+      <contributor>
+        <ip>192.0.2.1</ip>
+      </contributor>
+      <minor />
+      <comment>old</comment>
+      <text xml:space="preserve">older</text>
+    </revision>
+    <revision>
+      <id>3009</id>
+      <contributor>
+        <username>Bob</username>
+      </contributor>
+      <text xml:space="preserve">newer</text>
+    </revision>
+  </page>
+  <page>
+    <title>New Page</title>
+    <ns>0</ns>
+    <id>1000</id>
+    <revision>
+      <id>2100</id>
+      <text xml:space="preserve">new</text>
+    </revision>
+  </page>
+</mediawiki>
+`
+
+const testLoggingDump = `<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/" version="0.10" xml:lang="en">
+  <logitem>
+    <id>1</id>
+    <timestamp>2017-06-01T00:00:00Z</timestamp>
+    <type>delete</type>
+    <action>delete</action>
+    <logtitle>Page 12</logtitle>
+  </logitem>
+  <logitem>
+    <id>2</id>
+    <timestamp>2018-02-01T12:00:00Z</timestamp>
+    <type>delete</type>
+    <action>delete</action>
+    <logtitle>Page_10</logtitle>
+  </logitem>
+  <logitem>
+    <id>3</id>
+    <timestamp>2018-02-01T12:00:00Z</timestamp>
+    <type>delete</type>
+    <action>delete</action>
+    <logtitle>Page 11</logtitle>
+  </logitem>
+  <logitem>
+    <id>4</id>
+    <timestamp>2018-02-01T13:00:00Z</timestamp>
+    <type>delete</type>
+    <action>restore</action>
+    <logtitle>Page 11</logtitle>
+  </logitem>
+  <logitem>
+    <id>5</id>
+    <timestamp>2018-02-01T12:00:00Z</timestamp>
+    <type>move</type>
+    <action>move</action>
+    <logtitle>Page 13</logtitle>
+  </logitem>
+</mediawiki>
+`
+
+// testIncrementalDump2 is the next day's dump, which moves a page from
+// testIncrementalDump again and recreates a page deleted earlier that day.
+const testIncrementalDump2 = `<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/" version="0.10" xml:lang="en">
+  <page>
+    <title>Moved Again</title>
+    <ns>0</ns>
+    <id>7</id>
+    <revision>
+      <id>2207</id>
+      <text xml:space="preserve">moved again</text>
+    </revision>
+  </page>
+  <page>
+    <title>Recreated</title>
+    <ns>0</ns>
+    <id>1001</id>
+    <revision>
+      <id>2201</id>
+      <timestamp>2018-02-02T09:00:00Z</timestamp>
+      <text xml:space="preserve">recreated</text>
+    </revision>
+  </page>
+</mediawiki>
+`
+
+const testLoggingDump2 = `<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/" version="0.10" xml:lang="en">
+  <logitem>
+    <id>6</id>
+    <timestamp>2018-02-02T08:00:00Z</timestamp>
+    <type>delete</type>
+    <action>delete</action>
+    <logtitle>Recreated</logtitle>
+  </logitem>
+</mediawiki>
+`
+
+func TestApplyIncremental(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base, err := ioutil.ReadFile(testDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basePath := filepath.Join(dir, "testwiki-20180101-pages-articles.xml.bz2")
+	if err := ioutil.WriteFile(basePath, base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	incrDir := filepath.Join(dir, "incr", "20180201")
+	if err := os.MkdirAll(incrDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"testwiki-20180201-pages-meta-hist-incr.xml": testIncrementalDump,
+		"testwiki-20180201-pages-logging.xml":        testLoggingDump,
+		"testwiki-20180202-pages-meta-hist-incr.xml": testIncrementalDump2,
+		"testwiki-20180202-pages-logging.xml":        testLoggingDump2,
+		"testwiki-20180201-stubs-meta-hist-incr.xml": "not a dump",
+		"otherwiki-20180201-pages-logging.xml":       "not a dump",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(incrDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := *incrementalDir
+	defer func() { *incrementalDir = old }()
+	*incrementalDir = filepath.Join(dir, "incr")
+
+	wk := newWiki("", basePath, "")
+	wk.cache = newStreamCache(1 << 20)
+	wk.format = wk.detectFormat()
+	if err := wk.loadSiteInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wk.loadTitleIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if s := wk.snapshot(); len(s.incremental) != 2 || len(s.deletionLogs) != 2 {
+		t.Fatalf("found %d incremental dumps and %d logs; not 2 and 2", len(s.incremental), len(s.deletionLogs))
+	}
+	// Two pages were added and one deleted.
+	if n := wk.titles().len(); n != 301 {
+		t.Errorf("indexed %d titles; not 301", n)
+	}
+
+	cases := []struct {
+		title string
+		id    int
+		text  string
+	}{
+		{"Page 5", 5, "updated"},
+		{"Moved Again", 7, "moved again"},
+		{"Recreated", 1001, "recreated"},
+		{"Page 9", 9, "newer"},
+		{"New Page", 1000, "new"},
+		{"Page 6", 6, ""},
+		{"Page 11", 11, ""},
+		{"Page 12", 12, ""},
+		{"Page 13", 13, ""},
+		{"Page 201", 201, ""},
+	}
+	for _, c := range cases {
+		meta, err := wk.fetchArticle(c.title)
+		if err != nil {
+			t.Errorf("%q: %+v", c.title, err)
+			continue
+		}
+		p, err := wk.readArticle(meta)
+		if err != nil {
+			t.Errorf("reading %q: %+v", c.title, err)
+			continue
+		}
+		if p.ID != c.id || p.Title != c.title {
+			t.Errorf("read %d %q; not %d %q", p.ID, p.Title, c.id, c.title)
+		}
+		if c.text != "" && p.Text != c.text {
+			t.Errorf("%q has text %q; not %q", c.title, p.Text, c.text)
+		}
+		// Only the last revision counts.
+		if c.title == "Page 9" && (p.RevisionID != "3009" || p.Username != "Bob" || p.IP != "" || p.Minor != nil || p.Comment != "") {
+			t.Errorf("%q has fields from an earlier revision: %+v", c.title, p)
+		}
+	}
+
+	for _, title := range []string{"Page 7", "Moved Page", "Page 10"} {
+		if _, err := wk.fetchArticle(title); err == nil {
+			t.Errorf("%q should have been removed", title)
+		}
+	}
+}
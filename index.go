@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/creachadair/cityhash"
+	pbzip2 "github.com/d4l3k/go-pbzip2"
+	"github.com/pkg/errors"
+)
+
+// indexMagic identifies a compact title index file. The last byte is the
+// format version and is bumped whenever the layout changes.
+var indexMagic = [8]byte{'w', 'g', 'i', 'n', 'd', 'e', 'x', 5}
+
+var errStaleIndex = errors.New("index file is stale")
+
+// maxTitleLen is the longest title in bytes. MediaWiki limits titles to 255
+// bytes not counting the namespace, which gets the rest. Longer lengths read
+// from an index file mean it's corrupt.
+const maxTitleLen = 512
+
+// indexHeader is the fixed size header at the start of a compact title index
+// file. SourceSize and SourceModTime record the bz2 index the file was built
+// from so it can be rebuilt when that changes.
+//
+// The header is followed by the entries, then the hashes, positions and
+// buckets of the index as little endian integers so they don't have to be
+// recomputed on every load. HashBits is the number of bits used for buckets.
+type indexHeader struct {
+	Magic         [8]byte
+	SourceSize    int64
+	SourceModTime int64
+	Entries       uint64
+	HashBits      uint64
+}
+
+// indexChunk is the number of integers read or written at a time so the
+// hashes are never buffered whole.
+const indexChunk = 1 << 16
+
+// chunks calls f with consecutive ranges of at most indexChunk of n items.
+func chunks(n int, f func(i, j int) error) error {
+	for i := 0; i < n; i += indexChunk {
+		j := i + indexChunk
+		if j > n {
+			j = n
+		}
+		if err := f(i, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wk *wiki) indexCachePath() string {
+	if wk.indexCacheFile != "" {
+		return wk.indexCacheFile
+	}
+	return wk.titleSource() + ".idx"
+}
+
+// titleIndex maps article titles to their location in the articles dump.
+// Titles are kept in sorted order so they can be listed and prefix searched,
+// and are hashed for fast lookups.
+//
+// Full dumps have tens of millions of titles so everything is packed into a
+// few flat slices instead of a string, struct and map entry per title.
+type titleIndex struct {
+	// data holds every title concatenated in sorted order. Title i ends at
+	// ends[i] and starts where the previous one ends.
+	data string
+	ends []uint32
+
+	// ids, streamIDs and ns hold the entry of each title. The stream is
+	// stored as its position in offsets rather than the offset itself.
+	ids       []uint32
+	streamIDs []uint32
+	ns        []int16
+
+	// hashes are the hashes of every title in sorted order and positions
+	// the titles they belong to. Titles with colliding hashes are next to
+	// each other.
+	hashes    []uint64
+	positions []uint32
+	// buckets[b] is the first hash whose top hashBits bits are b, so lookups
+	// only have to search within a bucket.
+	buckets  []uint32
+	hashBits uint
+
+	// offsets are the sorted offsets of every stream and sizes the number of
+	// pages in each, counted from the titles in it.
+	//
+	// Titles are sorted by title rather than by stream, so their offsets
+	// can't be delta encoded per stream. Instead each distinct offset is
+	// stored once here and titles refer to it by its 4 byte position. With
+	// about 100 pages per stream this table is well under a byte per title.
+	// Delta encoding it too would save about 0.04 bytes per title but make
+	// entry and streamSize scan the deltas, so it's kept as plain offsets.
+	offsets []int
+	sizes   []uint32
+}
+
+// newTitleIndex creates an index from titles and entries which must already
+// be sorted by title.
+func newTitleIndex(titles []string, entries []indexEntry) (*titleIndex, error) {
+	b := newTitleIndexBuilder(len(titles))
+	for i, title := range titles {
+		if err := b.add(title, entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return b.finish(), nil
+}
+
+// titleIndexBuilder builds a titleIndex from titles added in sorted order
+// without keeping them all as separate strings.
+type titleIndexBuilder struct {
+	idx     *titleIndex
+	data    []byte
+	offsets []int
+}
+
+func newTitleIndexBuilder(n int) *titleIndexBuilder {
+	return &titleIndexBuilder{
+		idx: &titleIndex{
+			ends:      make([]uint32, 0, n),
+			ids:       make([]uint32, 0, n),
+			streamIDs: make([]uint32, 0, n),
+			ns:        make([]int16, 0, n),
+		},
+	}
+}
+
+// add appends title, which must sort after every title added so far. The
+// titles are addressed with 32 bit offsets so it returns an error once they
+// don't fit.
+func (b *titleIndexBuilder) add(title string, entry indexEntry) error {
+	idx := b.idx
+	if len(title) > maxTitleLen {
+		return errors.Errorf("title %q is longer than %d bytes", title, maxTitleLen)
+	}
+	if len(b.data)+len(title) > math.MaxUint32 {
+		return errors.Errorf("titles are longer than %d bytes in total", uint32(math.MaxUint32))
+	}
+	b.data = append(b.data, title...)
+	idx.ends = append(idx.ends, uint32(len(b.data)))
+	idx.ids = append(idx.ids, uint32(entry.id))
+	idx.ns = append(idx.ns, int16(entry.ns))
+	// The stream offsets are replaced with their positions in finishEntries.
+	b.offsets = append(b.offsets, entry.seek)
+	return nil
+}
+
+// finish returns the index of the titles added, hashing them for lookups.
+func (b *titleIndexBuilder) finish() *titleIndex {
+	idx := b.finishEntries()
+	idx.hashTitles()
+	return idx
+}
+
+// finishEntries returns the index of the titles added without the hashes
+// used for lookups.
+func (b *titleIndexBuilder) finishEntries() *titleIndex {
+	idx := b.idx
+	idx.data = string(b.data)
+	b.data = nil
+
+	idx.offsets = append([]int(nil), b.offsets...)
+	sort.Ints(idx.offsets)
+	offsets := idx.offsets[:0]
+	for i, seek := range idx.offsets {
+		if i == 0 || seek != offsets[len(offsets)-1] {
+			offsets = append(offsets, seek)
+		}
+	}
+	idx.offsets = offsets
+	idx.sizes = make([]uint32, len(offsets))
+	for _, seek := range b.offsets {
+		stream := sort.SearchInts(offsets, seek)
+		idx.streamIDs = append(idx.streamIDs, uint32(stream))
+		idx.sizes[stream]++
+	}
+	b.offsets = nil
+	return idx
+}
+
+// hashTitles hashes every title and sorts the hashes into buckets.
+func (idx *titleIndex) hashTitles() {
+	idx.hashes = make([]uint64, idx.len())
+	idx.positions = make([]uint32, idx.len())
+	for i := range idx.hashes {
+		idx.hashes[i] = cityhash.Hash64([]byte(idx.title(i)))
+		idx.positions[i] = uint32(i)
+	}
+	sort.Sort(titleHashes{idx})
+
+	// Use about one bucket per title.
+	for 1<<(idx.hashBits+1) <= len(idx.hashes) {
+		idx.hashBits++
+	}
+	idx.buckets = make([]uint32, 1<<idx.hashBits+1)
+	j := 0
+	for bucket := range idx.buckets {
+		for j < len(idx.hashes) && idx.bucket(idx.hashes[j]) < bucket {
+			j++
+		}
+		idx.buckets[bucket] = uint32(j)
+	}
+}
+
+// bucket returns the bucket of hash.
+func (idx *titleIndex) bucket(hash uint64) int {
+	if idx.hashBits == 0 {
+		return 0
+	}
+	return int(hash >> (64 - idx.hashBits))
+}
+
+// titleHashes sorts the hashes of an index along with their positions.
+type titleHashes struct {
+	*titleIndex
+}
+
+func (h titleHashes) Len() int           { return len(h.hashes) }
+func (h titleHashes) Less(i, j int) bool { return h.hashes[i] < h.hashes[j] }
+func (h titleHashes) Swap(i, j int) {
+	h.hashes[i], h.hashes[j] = h.hashes[j], h.hashes[i]
+	h.positions[i], h.positions[j] = h.positions[j], h.positions[i]
+}
+
+func (idx *titleIndex) len() int {
+	return len(idx.ends)
+}
+
+// title returns the title at position i.
+func (idx *titleIndex) title(i int) string {
+	start := uint32(0)
+	if i > 0 {
+		start = idx.ends[i-1]
+	}
+	return idx.data[start:idx.ends[i]]
+}
+
+// entry returns the entry at position i.
+func (idx *titleIndex) entry(i int) indexEntry {
+	return indexEntry{
+		id:   int(idx.ids[i]),
+		seek: idx.offsets[idx.streamIDs[i]],
+		ns:   int(idx.ns[i]),
+	}
+}
+
+// lookup returns the entry for the exact title.
+func (idx *titleIndex) lookup(title string) (indexEntry, bool) {
+	titleHash := cityhash.Hash64([]byte(title))
+	bucket := idx.bucket(titleHash)
+	lo, hi := int(idx.buckets[bucket]), int(idx.buckets[bucket+1])
+	for j := lo + sort.Search(hi-lo, func(j int) bool {
+		return idx.hashes[lo+j] >= titleHash
+	}); j < hi && idx.hashes[j] == titleHash; j++ {
+		if i := int(idx.positions[j]); idx.title(i) == title {
+			return idx.entry(i), true
+		}
+	}
+	return indexEntry{}, false
+}
+
+// streamSize returns the number of pages in the stream at seek.
+func (idx *titleIndex) streamSize(seek int) int {
+	i := sort.SearchInts(idx.offsets, seek)
+	if i == len(idx.offsets) || idx.offsets[i] != seek {
+		return 0
+	}
+	return int(idx.sizes[i])
+}
+
+// streamEnd returns the offset of the stream after the one at seek in the
+// same file, or false if it's the last one in the index.
+func (idx *titleIndex) streamEnd(seek int) (int, bool) {
+	i := sort.SearchInts(idx.offsets, seek+1)
+	if i == len(idx.offsets) || idx.offsets[i]>>incrementalShift != seek>>incrementalShift {
+		return 0, false
+	}
+	return idx.offsets[i], true
+}
+
+// setStreamSizes overrides the number of pages in the streams in sizes. It's
+// used when some pages in a stream have been superseded and aren't in the
+// index but still have to be read past.
+func (idx *titleIndex) setStreamSizes(sizes map[int]int) {
+	for i, seek := range idx.offsets {
+		if n, ok := sizes[seek]; ok {
+			idx.sizes[i] = uint32(n)
+		}
+	}
+}
+
+// find returns the position of the first title greater than or equal to
+// from.
+func (idx *titleIndex) find(from string) int {
+	return sort.Search(idx.len(), func(i int) bool {
+		return idx.title(i) >= from
+	})
+}
+
+// titleAt returns the title and entry at position i.
+func (idx *titleIndex) titleAt(i int) (string, indexEntry) {
+	return idx.title(i), idx.entry(i)
+}
+
+// ascend calls f for each title greater than or equal to from in sorted order
+// until f returns false.
+func (idx *titleIndex) ascend(from string, f func(title string, entry indexEntry) bool) {
+	for i := idx.find(from); i < idx.len(); i++ {
+		if !f(idx.titleAt(i)) {
+			return
+		}
+	}
+}
+
+// loadTitleIndex loads the compact title index, building it from the bz2
+// index or by scanning the dump first if it's missing or out of date.
+func (wk *wiki) loadTitleIndex() error {
+	idx, err := wk.loadIndexFile(wk.indexCachePath(), wk.titleSource(), wk.readTitles)
+	if err != nil {
+		return err
+	}
+	var dumps []incrementalDump
+	var logs []string
+	if *incrementalDir != "" {
+		idx, dumps, logs, err = wk.applyIncremental(idx)
+		if err != nil {
+			return err
+		}
+	}
+	// The dumps are published with the index so offsets into them are
+	// never seen without them.
+	wk.updateSnapshot(func(s *snapshot) {
+		s.titles = idx
+		s.incremental = dumps
+		s.deletionLogs = logs
+	})
+	return nil
+}
+
+// loadIndexFile loads the compact index file at path, building it from the
+// titles passed to f by read if it's missing or older than sourcePath.
+func (wk *wiki) loadIndexFile(path, sourcePath string, read func(f func(title string, entry indexEntry) error) error) (*titleIndex, error) {
+	source, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := wk.readIndexFile(path, source)
+	if err == nil {
+		return idx, nil
+	}
+	if os.IsNotExist(errors.Cause(err)) {
+		log.Printf("No index file at %q, building it...", path)
+	} else {
+		log.Printf("Rebuilding index file %q: %v", path, err)
+	}
+	return wk.buildIndexFile(path, source, read)
+}
+
+// readBZ2Index reads the multistream index and calls f for every entry in
+// it.
+func (wk *wiki) readBZ2Index(path string, f func(title string, entry indexEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := pbzip2.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+
+	log.Printf("Reading index file...")
+	wk.status.setPhase("Reading index file", 0)
+	i := 0
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		if len(parts) < 3 {
+			return errors.Errorf("expected at least 3 parts, got: %#v", parts)
+		}
+		seek, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return err
+		}
+		title := strings.Join(parts[2:], ":")
+		if err := f(title, indexEntry{
+			id:   id,
+			seek: seek,
+		}); err != nil {
+			return err
+		}
+
+		i++
+		if i%100000 == 0 {
+			log.Printf("read %d entries", i)
+			wk.status.setEntries(i)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	log.Printf("Done reading!")
+	return nil
+}
+
+type titleEntries struct {
+	titles  []string
+	entries []indexEntry
+}
+
+func (t titleEntries) Len() int           { return len(t.titles) }
+func (t titleEntries) Less(i, j int) bool { return t.titles[i] < t.titles[j] }
+func (t titleEntries) Swap(i, j int) {
+	t.titles[i], t.titles[j] = t.titles[j], t.titles[i]
+	t.entries[i], t.entries[j] = t.entries[j], t.entries[i]
+}
+
+// buildIndexFile reads every title and writes the compact index file to
+// path. The file is written to a temporary location first so a crash never
+// leaves a truncated index behind.
+func (wk *wiki) buildIndexFile(path string, source os.FileInfo, read func(f func(title string, entry indexEntry) error) error) (*titleIndex, error) {
+	namespaces := wk.namespaces()
+	var t titleEntries
+	if err := read(func(title string, entry indexEntry) error {
+		title = namespaces.normalize(title)
+		entry.ns, _ = namespaces.split(title)
+		t.titles = append(t.titles, title)
+		t.entries = append(t.entries, entry)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	wk.status.setPhase("Writing index file", 0)
+	sort.Stable(t)
+
+	idx, err := newTitleIndex(t.titles, t.entries)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeIndexFile(path, source, idx); err != nil {
+		return nil, err
+	}
+	log.Printf("Wrote %d entries to %q", idx.len(), path)
+	return idx, nil
+}
+
+func writeIndexFile(path string, source os.FileInfo, idx *titleIndex) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	if err := binary.Write(bw, binary.LittleEndian, indexHeader{
+		Magic:         indexMagic,
+		SourceSize:    source.Size(),
+		SourceModTime: source.ModTime().UnixNano(),
+		Entries:       uint64(idx.len()),
+		HashBits:      uint64(idx.hashBits),
+	}); err != nil {
+		return err
+	}
+	w := newIndexWriter(bw)
+	for i := 0; i < idx.len(); i++ {
+		if err := w.write(idx.titleAt(i)); err != nil {
+			return err
+		}
+	}
+	if err := chunks(len(idx.hashes), func(i, j int) error {
+		return binary.Write(bw, binary.LittleEndian, idx.hashes[i:j])
+	}); err != nil {
+		return err
+	}
+	if err := chunks(len(idx.positions), func(i, j int) error {
+		return binary.Write(bw, binary.LittleEndian, idx.positions[i:j])
+	}); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, idx.buckets); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readIndexFile loads a compact index file. It returns errStaleIndex if the
+// file wasn't built from source.
+func (wk *wiki) readIndexFile(path string, source os.FileInfo) (*titleIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header indexHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, errors.Wrapf(err, "reading header")
+	}
+	if header.Magic != indexMagic {
+		return nil, errors.Errorf("unknown index format %q", header.Magic[:])
+	}
+	if header.SourceSize != source.Size() || header.SourceModTime != source.ModTime().UnixNano() {
+		return nil, errStaleIndex
+	}
+	// Every entry takes at least 17 bytes: 5 varints, a hash and a position.
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if header.Entries > uint64(info.Size())/17 {
+		return nil, errors.Errorf("%d entries don't fit in %d bytes", header.Entries, info.Size())
+	}
+	n := int(header.Entries)
+	if header.HashBits > 32 || n > 0 && 1<<header.HashBits > n {
+		return nil, errors.Errorf("invalid hash bits %d for %d entries", header.HashBits, n)
+	}
+
+	log.Printf("Loading %d entries from %q...", n, path)
+	wk.status.setPhase("Loading index file", n)
+	b := newTitleIndexBuilder(n)
+	ir := indexReader{r: r}
+	for i := 0; i < n; i++ {
+		title, entry, err := ir.read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading entry %d", i)
+		}
+		if err := b.add(title, entry); err != nil {
+			return nil, err
+		}
+		if i%100000 == 0 {
+			wk.status.setEntries(i)
+		}
+	}
+	idx := b.finishEntries()
+	if err := idx.readHashes(r, uint(header.HashBits)); err != nil {
+		return nil, errors.Wrapf(err, "reading hashes")
+	}
+	log.Printf("Done loading!")
+	return idx, nil
+}
+
+// readHashes reads the hashes, positions and buckets written after the
+// entries of an index file and checks they're in range for the index.
+func (idx *titleIndex) readHashes(r io.Reader, hashBits uint) error {
+	n := idx.len()
+	idx.hashes = make([]uint64, n)
+	idx.positions = make([]uint32, n)
+	idx.buckets = make([]uint32, 1<<hashBits+1)
+	idx.hashBits = hashBits
+	if err := chunks(n, func(i, j int) error {
+		return binary.Read(r, binary.LittleEndian, idx.hashes[i:j])
+	}); err != nil {
+		return err
+	}
+	if err := chunks(n, func(i, j int) error {
+		return binary.Read(r, binary.LittleEndian, idx.positions[i:j])
+	}); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, idx.buckets); err != nil {
+		return err
+	}
+	for _, i := range idx.positions {
+		if int(i) >= n {
+			return errors.Errorf("position %d out of range", i)
+		}
+	}
+	for b, j := range idx.buckets {
+		if b > 0 && j < idx.buckets[b-1] || int(j) > n {
+			return errors.Errorf("bucket %d starts at %d", b, j)
+		}
+	}
+	if idx.buckets[len(idx.buckets)-1] != uint32(n) {
+		return errors.Errorf("buckets end at %d; not %d", idx.buckets[len(idx.buckets)-1], n)
+	}
+	return nil
+}
+
+// indexWriter encodes index entries in title order. Each title is prefix
+// compressed against the previous one: the length of the shared prefix and the
+// remaining suffix are written, followed by the stream offset, page ID and
+// namespace as varints.
+type indexWriter struct {
+	w     *bufio.Writer
+	title string
+	buf   [3 * binary.MaxVarintLen64]byte
+}
+
+func newIndexWriter(w *bufio.Writer) *indexWriter {
+	return &indexWriter{w: w}
+}
+
+func (w *indexWriter) write(title string, entry indexEntry) error {
+	shared := commonPrefix(w.title, title)
+	n := binary.PutUvarint(w.buf[:], uint64(shared))
+	n += binary.PutUvarint(w.buf[n:], uint64(len(title)-shared))
+	if _, err := w.w.Write(w.buf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.w.WriteString(title[shared:]); err != nil {
+		return err
+	}
+	n = binary.PutUvarint(w.buf[:], uint64(entry.seek))
+	n += binary.PutUvarint(w.buf[n:], uint64(entry.id))
+	n += binary.PutVarint(w.buf[n:], int64(entry.ns))
+	w.title = title
+	_, err := w.w.Write(w.buf[:n])
+	return err
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+type indexReader struct {
+	r     *bufio.Reader
+	title []byte
+}
+
+func (r *indexReader) read() (string, indexEntry, error) {
+	shared, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	suffix, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	if shared > uint64(len(r.title)) {
+		return "", indexEntry{}, errors.Errorf("shared prefix %d longer than previous title %q", shared, r.title)
+	}
+	if suffix > maxTitleLen-shared {
+		return "", indexEntry{}, errors.Errorf("title longer than %d bytes", maxTitleLen)
+	}
+	r.title = append(r.title[:shared], make([]byte, suffix)...)
+	if _, err := io.ReadFull(r.r, r.title[shared:]); err != nil {
+		return "", indexEntry{}, err
+	}
+	seek, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	id, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	ns, err := binary.ReadVarint(r.r)
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	return string(r.title), indexEntry{
+		id:   int(id),
+		seek: int(seek),
+		ns:   int(ns),
+	}, nil
+}
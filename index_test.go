@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/creachadair/cityhash"
+)
+
+func TestIndexWriterReader(t *testing.T) {
+	titles := []string{
+		"AccessibleComputing",
+		"Accessible Computing",
+		"Anarchism",
+		"Anarchism in France",
+		"B",
+	}
+	entries := []indexEntry{
+		{id: 10, seek: 616},
+		{id: 12, seek: 616},
+		{id: 5000, seek: 654321},
+		{id: 5001, seek: 1 << 40},
+		{id: 1, seek: 0, ns: -1},
+	}
+
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	w := newIndexWriter(bw)
+	for i, title := range titles {
+		if err := w.write(title, entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := indexReader{r: bufio.NewReader(&buf)}
+	for i, want := range titles {
+		title, entry, err := r.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if title != want || entry != entries[i] {
+			t.Errorf("%d. read() = %q, %+v; not %q, %+v", i, title, entry, want, entries[i])
+		}
+	}
+}
+
+func TestIndexReaderLongTitle(t *testing.T) {
+	var buf bytes.Buffer
+	var b [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], 0)
+	n += binary.PutUvarint(b[n:], 1<<40)
+	buf.Write(b[:n])
+	r := indexReader{r: bufio.NewReader(&buf)}
+	if _, _, err := r.read(); err == nil {
+		t.Errorf("read a %d byte title", 1<<40)
+	}
+}
+
+// testTitleIndex creates an index from sorted titles and entries.
+func testTitleIndex(t *testing.T, titles []string, entries []indexEntry) *titleIndex {
+	idx, err := newTitleIndex(titles, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestTitleIndexLookup(t *testing.T) {
+	idx := testTitleIndex(t,
+		[]string{"A", "B", "C"},
+		[]indexEntry{{id: 1}, {id: 2}, {id: 3}},
+	)
+	// Pretend "A" also has the hash of "B" so they collide.
+	hashB := cityhash.Hash64([]byte("B"))
+	idx.hashes = append(idx.hashes, hashB)
+	idx.positions = append(idx.positions, 0)
+	sort.Sort(titleHashes{idx})
+	for b := idx.bucket(hashB) + 1; b < len(idx.buckets); b++ {
+		idx.buckets[b]++
+	}
+
+	cases := []struct {
+		title string
+		want  indexEntry
+		ok    bool
+	}{
+		{"A", indexEntry{id: 1}, true},
+		{"B", indexEntry{id: 2}, true},
+		{"C", indexEntry{id: 3}, true},
+		{"D", indexEntry{}, false},
+	}
+	for _, c := range cases {
+		got, ok := idx.lookup(c.title)
+		if got != c.want || ok != c.ok {
+			t.Errorf("lookup(%q) = %+v, %t; not %+v, %t", c.title, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestTitleIndexAscend(t *testing.T) {
+	idx := testTitleIndex(t,
+		[]string{"Apple", "Banana", "Bandana", "Cherry"},
+		make([]indexEntry, 4),
+	)
+	var got []string
+	idx.ascend("Ban", func(title string, entry indexEntry) bool {
+		got = append(got, title)
+		return len(got) < 2
+	})
+	want := []string{"Banana", "Bandana"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ascend(%q) = %q; not %q", "Ban", got, want)
+	}
+}
+
+func TestTitleIndexStreams(t *testing.T) {
+	idx := testTitleIndex(t,
+		[]string{"A", "B", "C", "D"},
+		[]indexEntry{{id: 1, seek: 1 << 40}, {id: 2, seek: 600}, {id: 3, seek: 600, ns: -1}, {id: 4, seek: 600}},
+	)
+	if got, want := idx.streams(), []int{600, 1 << 40}; !reflect.DeepEqual(got, want) {
+		t.Errorf("streams() = %v; not %v", got, want)
+	}
+	for seek, want := range map[int]int{600: 3, 1 << 40: 1, 700: 0} {
+		if got := idx.streamSize(seek); got != want {
+			t.Errorf("streamSize(%d) = %d; not %d", seek, got, want)
+		}
+	}
+	if _, entry := idx.titleAt(2); entry != (indexEntry{id: 3, seek: 600, ns: -1}) {
+		t.Errorf("titleAt(2) = %+v", entry)
+	}
+
+	idx.setStreamSizes(map[int]int{600: 5, 700: 1})
+	if got := idx.streamSize(600); got != 5 {
+		t.Errorf("after setStreamSizes streamSize(600) = %d; not 5", got)
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sourcePath := filepath.Join(dir, "index.txt.bz2")
+	if err := ioutil.WriteFile(sourcePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := os.Stat(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{0, 1, 1000} {
+		titles, entries := benchmarkTitles(n)
+		want := testTitleIndex(t, titles, entries)
+		path := filepath.Join(dir, fmt.Sprintf("%d.idx", n))
+		if err := writeIndexFile(path, source, want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := newWiki("", "", "").readIndexFile(path, source)
+		if err != nil {
+			t.Fatalf("%d entries: %+v", n, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d entries: read a different index than was written", n)
+		}
+	}
+}
+
+// mapTitleIndex is the original title index, with a map entry per title
+// hash and a map of stream sizes, for comparison in benchmarks. It doesn't
+// keep the titles so it can only look them up.
+type mapTitleIndex struct {
+	offsets    map[uint64]mapIndexEntry
+	offsetSize map[int]int
+}
+
+// mapIndexEntry is the entry mapTitleIndex stored for each title.
+type mapIndexEntry struct {
+	id, seek int
+}
+
+func newMapTitleIndex(titles []string, entries []indexEntry) *mapTitleIndex {
+	idx := &mapTitleIndex{
+		offsets:    map[uint64]mapIndexEntry{},
+		offsetSize: map[int]int{},
+	}
+	for i, title := range titles {
+		entry := mapIndexEntry{id: entries[i].id, seek: entries[i].seek}
+		idx.offsets[cityhash.Hash64([]byte(title))] = entry
+		idx.offsetSize[entry.seek]++
+	}
+	return idx
+}
+
+func (idx *mapTitleIndex) lookup(title string) (mapIndexEntry, bool) {
+	entry, ok := idx.offsets[cityhash.Hash64([]byte(title))]
+	return entry, ok
+}
+
+// sortedMapTitleIndex is the title index as it was just before it was
+// packed, when titles were also kept sorted for listing and prefix search,
+// for comparison in benchmarks.
+type sortedMapTitleIndex struct {
+	titles     []string
+	entries    []indexEntry
+	hashes     map[uint64]int
+	collisions map[uint64][]int
+	offsetSize map[int]int
+}
+
+func newSortedMapTitleIndex(titles []string, entries []indexEntry) *sortedMapTitleIndex {
+	idx := &sortedMapTitleIndex{
+		titles:     titles,
+		entries:    entries,
+		hashes:     make(map[uint64]int, len(titles)),
+		collisions: map[uint64][]int{},
+		offsetSize: map[int]int{},
+	}
+	for i, title := range titles {
+		titleHash := cityhash.Hash64([]byte(title))
+		if _, ok := idx.hashes[titleHash]; ok {
+			idx.collisions[titleHash] = append(idx.collisions[titleHash], i)
+		} else {
+			idx.hashes[titleHash] = i
+		}
+		idx.offsetSize[entries[i].seek]++
+	}
+	return idx
+}
+
+func (idx *sortedMapTitleIndex) lookup(title string) (indexEntry, bool) {
+	titleHash := cityhash.Hash64([]byte(title))
+	i, ok := idx.hashes[titleHash]
+	if !ok {
+		return indexEntry{}, false
+	}
+	if idx.titles[i] == title {
+		return idx.entries[i], true
+	}
+	for _, i := range idx.collisions[titleHash] {
+		if idx.titles[i] == title {
+			return idx.entries[i], true
+		}
+	}
+	return indexEntry{}, false
+}
+
+// benchmarkTitles returns n sorted titles with entries in streams of 100
+// pages like a multistream dump.
+func benchmarkTitles(n int) ([]string, []indexEntry) {
+	r := rand.New(rand.NewSource(1))
+	titles := make([]string, n)
+	entries := make([]indexEntry, n)
+	for i := range titles {
+		titles[i] = fmt.Sprintf("Article %d about %x", i, r.Int63())
+		entries[i] = indexEntry{id: r.Intn(1 << 26), seek: r.Intn(n/100+1) * 1 << 20}
+	}
+	sort.Sort(titleEntries{titles, entries})
+	return titles, entries
+}
+
+// copyStrings copies s and the strings in it so they're counted by heapSize.
+func copyStrings(s []string) []string {
+	c := make([]string, len(s))
+	for i := range s {
+		c[i] = string([]byte(s[i]))
+	}
+	return c
+}
+
+// heapSize returns the bytes used by the value built by f.
+func heapSize(f func() interface{}) (uint64, interface{}) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	v := f()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	return after.HeapAlloc - before.HeapAlloc, v
+}
+
+func BenchmarkTitleIndex(b *testing.B) {
+	const n = 1000000
+	titles, entries := benchmarkTitles(n)
+
+	b.Run("packed", func(b *testing.B) {
+		size, v := heapSize(func() interface{} {
+			idx, err := newTitleIndex(copyStrings(titles), entries)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return idx
+		})
+		idx := v.(*titleIndex)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := idx.lookup(titles[i%n]); !ok {
+				b.Fatalf("%q not found", titles[i%n])
+			}
+		}
+		b.ReportMetric(float64(size)/n, "heap-bytes/title")
+	})
+	b.Run("map", func(b *testing.B) {
+		size, v := heapSize(func() interface{} {
+			return newMapTitleIndex(titles, entries)
+		})
+		idx := v.(*mapTitleIndex)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := idx.lookup(titles[i%n]); !ok {
+				b.Fatalf("%q not found", titles[i%n])
+			}
+		}
+		b.ReportMetric(float64(size)/n, "heap-bytes/title")
+	})
+	b.Run("sortedMap", func(b *testing.B) {
+		size, v := heapSize(func() interface{} {
+			return newSortedMapTitleIndex(copyStrings(titles), append([]indexEntry(nil), entries...))
+		})
+		idx := v.(*sortedMapTitleIndex)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := idx.lookup(titles[i%n]); !ok {
+				b.Fatalf("%q not found", titles[i%n])
+			}
+		}
+		b.ReportMetric(float64(size)/n, "heap-bytes/title")
+	})
+}
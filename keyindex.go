@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// keyBlockBits is log2 of the number of keys whose ends are stored relative
+// to the same base. The ends fit in 32 bits however big the index gets.
+const keyBlockBits = 12
+
+// maxKeyLen is the longest key in bytes: two titles, a sort key and the
+// separators between them. Links to longer titles aren't valid and are left
+// out of the index.
+const maxKeyLen = 2*maxTitleLen + maxSortKeyLen + 8
+
+// maxKeySourceLen is the longest source recorded in a key index file.
+const maxKeySourceLen = 1 << 20
+
+// keyRunBytes is roughly how many bytes of keys are sorted in memory at a
+// time while building a key index. Each sorted run is written to disk and
+// the runs are merged at the end.
+var keyRunBytes = 64 << 20
+
+// keyIndex is a sorted list of string keys, such as the category and backlink
+// indexes which are built by reading every page in the dump. Related entries
+// share a prefix so they're next to each other.
+//
+// There's about one key per link in the dump so like titleIndex they're
+// packed into one string instead of a string per key.
+type keyIndex struct {
+	// data holds every key concatenated in sorted order. Key i ends ends[i]
+	// bytes after bases[i>>keyBlockBits] and starts where the previous one
+	// ends.
+	data  string
+	ends  []uint32
+	bases []int
+}
+
+func (idx *keyIndex) len() int {
+	return len(idx.ends)
+}
+
+func (idx *keyIndex) end(i int) int {
+	return idx.bases[i>>keyBlockBits] + int(idx.ends[i])
+}
+
+// key returns the key at position i.
+func (idx *keyIndex) key(i int) string {
+	start := 0
+	if i > 0 {
+		start = idx.end(i - 1)
+	}
+	return idx.data[start:idx.end(i)]
+}
+
+// search returns the position of the first key greater than or equal to key.
+func (idx *keyIndex) search(key string) int {
+	return sort.Search(idx.len(), func(i int) bool {
+		return idx.key(i) >= key
+	})
+}
+
+// span returns the range of keys starting with prefix.
+func (idx *keyIndex) span(prefix string) (lo, hi int) {
+	// 0xff never appears in UTF-8 so it sorts after every key with prefix.
+	return idx.search(prefix), idx.search(prefix + "\xff")
+}
+
+// keyIndexBuilder builds a keyIndex from keys added in sorted order.
+type keyIndexBuilder struct {
+	idx  *keyIndex
+	data []byte
+}
+
+func newKeyIndexBuilder(n int) *keyIndexBuilder {
+	return &keyIndexBuilder{
+		idx: &keyIndex{
+			ends: make([]uint32, 0, n),
+		},
+	}
+}
+
+func (b *keyIndexBuilder) add(key []byte) {
+	idx := b.idx
+	if len(idx.ends)%(1<<keyBlockBits) == 0 {
+		idx.bases = append(idx.bases, len(b.data))
+	}
+	b.data = append(b.data, key...)
+	idx.ends = append(idx.ends, uint32(len(b.data)-idx.bases[len(idx.bases)-1]))
+}
+
+func (b *keyIndexBuilder) finish() *keyIndex {
+	idx := b.idx
+	idx.data = string(b.data)
+	b.data = nil
+	return idx
+}
+
+// loadKeyIndex loads the key index at path. If it's missing or wasn't built
+// from the current dump it's rebuilt by calling f with every page when build
+// is set, otherwise nil is returned.
+func (wk *wiki) loadKeyIndex(name, path string, magic [8]byte, build bool, f func(p page, entry indexEntry) []string) (*keyIndex, error) {
+	source, err := wk.indexSource()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := readKeyIndex(path, magic, source)
+	if err == nil {
+		return idx, nil
+	}
+	if !build {
+		if !os.IsNotExist(errors.Cause(err)) {
+			log.Printf("Not loading %s index %q: %v", name, path, err)
+		}
+		return nil, nil
+	}
+
+	// The keys are sorted in runs written next to the index, since there
+	// can be too many to sort in memory as separate strings.
+	dir, err := ioutil.TempDir(filepath.Dir(path), filepath.Base(path)+".runs")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	runs, err := wk.crawlKeys(name, dir, f)
+	if err != nil {
+		return nil, err
+	}
+	idx, err = writeKeyIndex(path, magic, source, runs)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Wrote %d %s index entries to %q", idx.len(), name, path)
+	return idx, nil
+}
+
+// keyRun is a file of n sorted keys.
+type keyRun struct {
+	path string
+	n    int
+}
+
+// crawlKeys reads every page in the dump and writes the keys f returns for
+// them to sorted runs in dir.
+func (wk *wiki) crawlKeys(name, dir string, f func(p page, entry indexEntry) []string) ([]keyRun, error) {
+	titles := wk.titles()
+	namespaces := wk.namespaces()
+	streams := titles.streams()
+
+	log.Printf("Building %s index from %d streams...", name, len(streams))
+	var mu sync.Mutex
+	var runs []keyRun
+	var keys []string
+	size := 0
+	flush := func() error {
+		sort.Strings(keys)
+		run, err := writeKeyRun(filepath.Join(dir, strconv.Itoa(len(runs))), keys)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		keys, size = nil, 0
+		return nil
+	}
+	done := 0
+	if err := wk.walkStreams(streams, *fullTextWorkers, func(seek int, pages []page) error {
+		var streamKeys []string
+		for _, p := range pages {
+			// Skip pages that have been replaced by an incremental dump.
+			entry, ok := titles.lookup(namespaces.normalize(p.Title))
+			if !ok || entry.id != p.ID || entry.seek != seek {
+				continue
+			}
+			for _, key := range f(p, entry) {
+				if len(key) <= maxKeyLen {
+					streamKeys = append(streamKeys, key)
+				}
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		keys = append(keys, streamKeys...)
+		for _, key := range streamKeys {
+			size += len(key)
+		}
+		if size >= keyRunBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		done++
+		if done%1000 == 0 {
+			log.Printf("Built %s index from %d/%d streams", name, done, len(streams))
+		}
+		return nil
+	}, func(seek int) error {
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return runs, nil
+}
+
+// writeKeyRun writes the sorted keys to a run file at path.
+func writeKeyRun(path string, keys []string) (keyRun, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return keyRun{}, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	kw := keyWriter{w: w}
+	for _, key := range keys {
+		if err := kw.write([]byte(key)); err != nil {
+			return keyRun{}, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return keyRun{}, err
+	}
+	return keyRun{path: path, n: len(keys)}, f.Close()
+}
+
+// writeKeyIndex merges the sorted runs into the key index at path and
+// returns it.
+func writeKeyIndex(path string, magic [8]byte, source string, runs []keyRun) (*keyIndex, error) {
+	count := 0
+	for _, run := range runs {
+		count += run.n
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var buf [2 * binary.MaxVarintLen64]byte
+	if _, err := w.Write(magic[:]); err != nil {
+		return nil, err
+	}
+	n := binary.PutUvarint(buf[:], uint64(len(source)))
+	n += binary.PutUvarint(buf[n:], uint64(count))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return nil, err
+	}
+	if _, err := w.WriteString(source); err != nil {
+		return nil, err
+	}
+	b := newKeyIndexBuilder(count)
+	kw := keyWriter{w: w}
+	if err := mergeKeyRuns(runs, func(key []byte) error {
+		b.add(key)
+		return kw.write(key)
+	}); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return b.finish(), nil
+}
+
+// mergeKeyRuns calls f with the keys of every run in sorted order. The key
+// passed to f is only valid until it returns.
+func mergeKeyRuns(runs []keyRun, f func(key []byte) error) error {
+	var h keyRunHeap
+	for _, run := range runs {
+		file, err := os.Open(run.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if run.n == 0 {
+			continue
+		}
+		r := &keyRunReader{keyReader: keyReader{r: bufio.NewReader(file)}, left: run.n - 1}
+		if err := r.read(); err != nil {
+			return errors.Wrapf(err, "reading %q", run.path)
+		}
+		h = append(h, r)
+	}
+	heap.Init(&h)
+	for len(h) > 0 {
+		r := h[0]
+		if err := f(r.key); err != nil {
+			return err
+		}
+		if r.left == 0 {
+			heap.Pop(&h)
+			continue
+		}
+		if err := r.read(); err != nil {
+			return err
+		}
+		r.left--
+		heap.Fix(&h, 0)
+	}
+	return nil
+}
+
+// keyRunReader reads a run being merged. left is the number of keys after
+// the current one.
+type keyRunReader struct {
+	keyReader
+	left int
+}
+
+// keyRunHeap orders runs by their current key.
+type keyRunHeap []*keyRunReader
+
+func (h keyRunHeap) Len() int            { return len(h) }
+func (h keyRunHeap) Less(i, j int) bool  { return bytes.Compare(h[i].key, h[j].key) < 0 }
+func (h keyRunHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyRunHeap) Push(x interface{}) { *h = append(*h, x.(*keyRunReader)) }
+func (h *keyRunHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// keyWriter writes sorted keys. Like the title index each key is prefix
+// compressed against the previous one.
+type keyWriter struct {
+	w    *bufio.Writer
+	prev []byte
+	buf  [2 * binary.MaxVarintLen64]byte
+}
+
+func (w *keyWriter) write(key []byte) error {
+	shared := 0
+	for shared < len(w.prev) && shared < len(key) && w.prev[shared] == key[shared] {
+		shared++
+	}
+	n := binary.PutUvarint(w.buf[:], uint64(shared))
+	n += binary.PutUvarint(w.buf[n:], uint64(len(key)-shared))
+	if _, err := w.w.Write(w.buf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(key[shared:]); err != nil {
+		return err
+	}
+	w.prev = append(w.prev[:0], key...)
+	return nil
+}
+
+// keyReader reads keys written by keyWriter.
+type keyReader struct {
+	r   *bufio.Reader
+	key []byte
+}
+
+// read reads the next key into r.key.
+func (r *keyReader) read() error {
+	shared, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return err
+	}
+	suffix, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return err
+	}
+	if shared > uint64(len(r.key)) {
+		return errors.Errorf("shared prefix %d longer than previous key %q", shared, r.key)
+	}
+	if suffix > maxKeyLen-shared {
+		return errors.Errorf("key longer than %d bytes", maxKeyLen)
+	}
+	r.key = append(r.key[:shared], make([]byte, suffix)...)
+	_, err = io.ReadFull(r.r, r.key[shared:])
+	return err
+}
+
+// readKeyIndex loads the key index at path. It returns errStaleIndex if it
+// wasn't built from source.
+func readKeyIndex(path string, magic [8]byte, source string) (*keyIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var fileMagic [8]byte
+	if _, err := io.ReadFull(r, fileMagic[:]); err != nil {
+		return nil, errors.Wrapf(err, "reading header")
+	}
+	if fileMagic != magic {
+		return nil, errors.Errorf("unknown index format %q", fileMagic[:])
+	}
+	sourceLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// Every key takes at least 2 bytes for its lengths.
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if sourceLen > maxKeySourceLen || count > uint64(info.Size())/2 {
+		return nil, errors.Errorf("invalid header: %d byte source and %d keys in %d bytes", sourceLen, count, info.Size())
+	}
+	prevSource := make([]byte, sourceLen)
+	if _, err := io.ReadFull(r, prevSource); err != nil {
+		return nil, err
+	}
+	if string(prevSource) != source {
+		return nil, errStaleIndex
+	}
+
+	log.Printf("Loading %d keys from %q...", count, path)
+	b := newKeyIndexBuilder(int(count))
+	kr := keyReader{r: r}
+	for i := 0; i < int(count); i++ {
+		if err := kr.read(); err != nil {
+			return nil, errors.Wrapf(err, "reading key %d", i)
+		}
+		b.add(kr.key)
+	}
+	return b.finish(), nil
+}
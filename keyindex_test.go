@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Enough keys for a few blocks, split over runs like crawlKeys does.
+	r := rand.New(rand.NewSource(1))
+	var all []string
+	var runs []keyRun
+	for i := 0; i < 4; i++ {
+		var keys []string
+		for j := 0; j < 3000*i; j++ {
+			keys = append(keys, fmt.Sprintf("%x\x00%d", r.Intn(500), r.Intn(1000)))
+		}
+		sort.Strings(keys)
+		run, err := writeKeyRun(filepath.Join(dir, strconv.Itoa(i)), keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, run)
+		all = append(all, keys...)
+	}
+	sort.Strings(all)
+
+	magic := [8]byte{'t', 'e', 's', 't'}
+	path := filepath.Join(dir, "keys.idx")
+	built, err := writeKeyIndex(path, magic, "source", runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if built.len() != len(all) {
+		t.Fatalf("built %d keys; not %d", built.len(), len(all))
+	}
+	for i, want := range all {
+		if got := built.key(i); got != want {
+			t.Fatalf("key(%d) = %q; not %q", i, got, want)
+		}
+	}
+
+	prefix := all[len(all)/2][:strings.IndexByte(all[len(all)/2], 0)+1]
+	lo, hi := built.span(prefix)
+	want := 0
+	for _, key := range all {
+		if strings.HasPrefix(key, prefix) {
+			want++
+		}
+	}
+	if hi-lo != want || !strings.HasPrefix(built.key(lo), prefix) {
+		t.Errorf("span(%q) = %d, %d; want %d keys", prefix, lo, hi, want)
+	}
+
+	read, err := readKeyIndex(path, magic, "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, built) {
+		t.Errorf("read a different index than was written")
+	}
+	if _, err := readKeyIndex(path, magic, "other"); err != errStaleIndex {
+		t.Errorf("readKeyIndex with another source = %v; not %v", err, errStaleIndex)
+	}
+}
+
+func TestReadKeyIndexCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	magic := [8]byte{'t', 'e', 's', 't'}
+	uvarints := func(xs ...uint64) []byte {
+		var b []byte
+		for _, x := range xs {
+			var buf [binary.MaxVarintLen64]byte
+			b = append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+		}
+		return b
+	}
+	cases := map[string][]byte{
+		"huge source": uvarints(1<<40, 1),
+		"huge count":  uvarints(0, 1<<40),
+		"huge key":    uvarints(0, 1, 0, 1<<40),
+	}
+	for name, body := range cases {
+		path := filepath.Join(dir, "keys.idx")
+		if err := ioutil.WriteFile(path, append(magic[:], body...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readKeyIndex(path, magic, ""); err == nil || err == errStaleIndex {
+			t.Errorf("%s: readKeyIndex = %v; want an error", name, err)
+		}
+	}
+}
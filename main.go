@@ -1,38 +1,47 @@
 package main
 
 import (
-	"bufio"
-	"compress/bzip2"
 	"encoding/xml"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
-	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"sync"
+	"time"
 
-	"github.com/blevesearch/bleve"
-	"github.com/creachadair/cityhash"
-	pbzip2 "github.com/d4l3k/go-pbzip2"
 	"github.com/d4l3k/wikigopher/wikitext"
 	"github.com/pkg/errors"
 )
 
 var (
-	indexFile       = flag.String("index", "enwiki-latest-pages-articles-multistream-index.txt.bz2", "the index file to load")
-	articlesFile    = flag.String("articles", "enwiki-latest-pages-articles-multistream.xml.bz2", "the article dump file to load")
+	indexFile       = flag.String("index", "enwiki-latest-pages-articles-multistream-index.txt.bz2", "the multistream index file to load, if it doesn't exist the articles dump is scanned instead")
+	indexCacheFile  = flag.String("indexCache", "", "the compact index file built from -index, defaults to the index path with a .idx suffix")
+	articlesFile    = flag.String("articles", "enwiki-latest-pages-articles-multistream.xml.bz2", "the article dump file to load, either .xml.bz2, .xml.gz or .xml")
+	incrementalDir  = flag.String("incremental", "", "a directory of incremental adds-changes dumps to apply on top of the articles dump")
 	search          = flag.Bool("search", false, "whether or not to build a search index")
 	searchIndexFile = flag.String("searchIndex", "index.bleve", "the search index file")
+	fullText        = flag.Bool("fulltext", false, "whether or not to index article text for full text search, requires -search")
+	fullTextWorkers = flag.Int("fulltextWorkers", 1, "the number of streams to decode at once while indexing article text or categories, verifying or building a static site")
+	categories      = flag.Bool("categories", false, "whether or not to build a category index by reading every page in the dump")
+	backlinks       = flag.Bool("backlinks", false, "whether or not to build an index of the links and templates on every page for Special:WhatLinksHere")
+	verifySHA1      = flag.Bool("verifySHA1", false, "whether or not to check the text of each page against its sha1 when it's read")
+	outDir          = flag.String("out", "site", "the directory the build command writes the static site to")
 	httpAddr        = flag.String("http", ":8080", "the address to bind HTTP to")
+	cacheSize       = flag.Int("cacheSize", 256, "the maximum size of decoded article streams to cache in MB, per wiki")
+	wikiFlags       wikiFlag
 )
 
+func init() {
+	flag.Var(&wikiFlags, "wiki", "a dump to serve under /name/ as name=articles.xml.bz2[,index.txt.bz2], may be repeated to serve several wikis instead of -articles and -index")
+}
+
 var tmpls = map[string]*template.Template{}
 
 func loadTemplates() error {
@@ -56,112 +65,36 @@ func executeTemplate(wr io.Writer, name string, data interface{}) error {
 
 type indexEntry struct {
 	id, seek int
+	ns       int
 }
 
-var mu = struct {
-	sync.Mutex
-
-	offsets    map[uint64]indexEntry
-	offsetSize map[int]int
-}{
-	offsets:    map[uint64]indexEntry{},
-	offsetSize: map[int]int{},
-}
-var index bleve.Index
-
-func loadIndex() error {
-	mapping := bleve.NewIndexMapping()
-	os.RemoveAll(*searchIndexFile)
-	var err error
-	index, err = bleve.New(*searchIndexFile, mapping)
-	if err != nil {
+// loadTitles loads the site info and title index, which is all that's needed
+// to read pages.
+func (wk *wiki) loadTitles() error {
+	wk.format = wk.detectFormat()
+	if err := wk.loadSiteInfo(); err != nil {
 		return err
 	}
-	f, err := os.Open(*indexFile)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	r, err := pbzip2.NewReader(f)
-	if err != nil {
+	return wk.loadTitleIndex()
+}
+
+func (wk *wiki) loadIndex() error {
+	if err := wk.loadTitles(); err != nil {
 		return err
 	}
-	defer r.Close()
-
-	scanner := bufio.NewScanner(r)
-
-	log.Printf("Reading index file...")
-	i := 0
-	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), ":")
-		if len(parts) < 3 {
-			return errors.Errorf("expected at least 3 parts, got: %#v", parts)
-		}
-		seek, err := strconv.Atoi(parts[0])
-		if err != nil {
-			return err
-		}
-		id, err := strconv.Atoi(parts[1])
-		if err != nil {
+	wk.status.setReady()
+
+	// These may each crawl the whole dump with -fulltextWorkers decoders, so
+	// they take turns to keep to that.
+	for _, load := range []func() error{
+		wk.loadSearchIndex,
+		wk.loadCategoryIndex,
+		wk.loadBacklinkIndex,
+	} {
+		if err := load(); err != nil {
 			return err
 		}
-		title := strings.Join(parts[2:], ":")
-		entry := indexEntry{
-			id:   id,
-			seek: seek,
-		}
-		titleHash := cityhash.Hash64([]byte(title))
-
-		mu.Lock()
-		mu.offsets[titleHash] = entry
-		mu.offsetSize[entry.seek]++
-		mu.Unlock()
-
-		i++
-		if i%100000 == 0 {
-			log.Printf("read %d entries", i)
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		return err
-	}
-	log.Printf("Done reading!")
-
-	if !*search {
-		return nil
 	}
-
-	/*
-		log.Printf("Indexing titles...")
-		i = 0
-		batch := index.NewBatch()
-
-		mu.Lock()
-		defer mu.Unlock()
-
-		for key, entry := range mu.offsets {
-			mu.Unlock()
-
-			if err := batch.Index(key, entry); err != nil {
-				mu.Lock()
-				return err
-			}
-			i++
-			if i%100000 == 0 {
-				if err := index.Batch(batch); err != nil {
-					mu.Lock()
-					return err
-				}
-				batch.Reset()
-				log.Printf("indexed %d entries", i)
-			}
-
-			mu.Lock()
-		}
-
-		log.Printf("Done indexing!")
-	*/
-
 	return nil
 }
 
@@ -199,88 +132,183 @@ type redirect struct {
 }
 
 type page struct {
-	XMLName    xml.Name   `xml:"page"`
-	Title      string     `xml:"title"`
-	NS         int        `xml:"ns"`
-	ID         int        `xml:"id"`
-	Redirect   []redirect `xml:"redirect"`
-	RevisionID string     `xml:"revision>id"`
-	Timestamp  string     `xml:"revision>timestamp"`
-	Username   string     `xml:"revision>contributor>username"`
-	UserID     string     `xml:"revision>contributor>id"`
-	Model      string     `xml:"revision>model"`
-	Format     string     `xml:"revision>format"`
-	Text       string     `xml:"revision>text"`
-}
-
-func readArticle(meta indexEntry) (page, error) {
-	f, err := os.Open(*articlesFile)
-	if err != nil {
-		return page{}, err
-	}
-	defer f.Close()
-
-	mu.Lock()
-	maxTries := mu.offsetSize[meta.seek]
-	mu.Unlock()
+	XMLName      xml.Name   `xml:"page"`
+	Title        string     `xml:"title"`
+	NS           int        `xml:"ns"`
+	ID           int        `xml:"id"`
+	Redirect     []redirect `xml:"redirect"`
+	Restrictions string     `xml:"restrictions"`
+	// The rest are from the page's last revision, see UnmarshalXML.
+	RevisionID string `xml:"-"`
+	ParentID   string `xml:"-"`
+	Timestamp  string `xml:"-"`
+	Username   string `xml:"-"`
+	UserID     string `xml:"-"`
+	IP         string `xml:"-"`
+	// Minor is non-nil for minor edits.
+	Minor   *struct{} `xml:"-"`
+	Comment string    `xml:"-"`
+	Model   string    `xml:"-"`
+	Format  string    `xml:"-"`
+	Text    string    `xml:"-"`
+	SHA1    string    `xml:"-"`
+
+	// corrupt is set by readArticle with -verifySHA1 if Text doesn't match
+	// SHA1.
+	corrupt error
+}
 
-	r := bzip2.NewReader(f)
+// revision is a <revision> of a page. Dumps of current pages have one per page
+// but history dumps, like the incremental ones, may have several.
+type revision struct {
+	ID        string    `xml:"id"`
+	ParentID  string    `xml:"parentid"`
+	Timestamp string    `xml:"timestamp"`
+	Username  string    `xml:"contributor>username"`
+	UserID    string    `xml:"contributor>id"`
+	IP        string    `xml:"contributor>ip"`
+	Minor     *struct{} `xml:"minor"`
+	Comment   string    `xml:"comment"`
+	Model     string    `xml:"model"`
+	Format    string    `xml:"format"`
+	Text      string    `xml:"text"`
+	SHA1      string    `xml:"sha1"`
+}
 
-	if _, err := f.Seek(int64(meta.seek), 0); err != nil {
-		return page{}, err
+// UnmarshalXML decodes a page with the fields of its last revision. Each
+// revision is decoded separately so fields it leaves out, such as <minor />,
+// aren't carried over from earlier ones.
+func (p *page) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	// Fields is exported so encoding/xml fills in the embedded fields.
+	type Fields page
+	var v struct {
+		Fields
+		Revisions []revision `xml:"revision"`
+	}
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	*p = page(v.Fields)
+	if len(v.Revisions) == 0 {
+		return nil
 	}
+	r := v.Revisions[len(v.Revisions)-1]
+	p.RevisionID, p.ParentID, p.Timestamp = r.ID, r.ParentID, r.Timestamp
+	p.Username, p.UserID, p.IP = r.Username, r.UserID, r.IP
+	p.Minor, p.Comment = r.Minor, r.Comment
+	p.Model, p.Format, p.Text, p.SHA1 = r.Model, r.Format, r.Text, r.SHA1
+	return nil
+}
 
-	d := xml.NewDecoder(r)
+// size returns the approximate number of bytes used by p.
+func (p page) size() int64 {
+	return int64(len(p.Title) + len(p.Restrictions) + len(p.RevisionID) +
+		len(p.ParentID) + len(p.Timestamp) + len(p.Username) + len(p.UserID) +
+		len(p.IP) + len(p.Comment) + len(p.Model) + len(p.Format) +
+		len(p.Text) + len(p.SHA1))
+}
 
-	var p page
-	for i := 0; i < maxTries; i++ {
-		if err := d.Decode(&p); err != nil {
+// readArticle returns the page at meta. The first read of a stream only
+// decodes it as far as the page that's wanted. If a later read misses, the
+// whole stream is decoded and cached instead.
+func (wk *wiki) readArticle(meta indexEntry) (page, error) {
+	// The stream is read with the same snapshot its size comes from even if
+	// the title index is swapped meanwhile.
+	s := wk.snapshot()
+	key := streamKey{titles: s.titles, seek: meta.seek}
+	id := meta.id
+	load := func() ([]page, error) {
+		pages, err := wk.readStreamUntil(s, meta.seek, id)
+		if err != nil || !*verifySHA1 {
+			return pages, err
+		}
+		// Pages are checked once when they're cached rather than on every
+		// read.
+		for i := range pages {
+			pages[i].corrupt = pages[i].verify()
+		}
+		return pages, nil
+	}
+	size := s.titles.streamSize(meta.seek)
+	for {
+		pages, err := wk.cache.get(key, load)
+		if err != nil {
 			return page{}, err
 		}
-		if p.ID == meta.id {
+		if p, ok := findPage(pages, meta.id); ok {
+			if p.corrupt != nil {
+				return page{}, p.corrupt
+			}
 			return p, nil
 		}
+		if len(pages) >= size {
+			return page{}, errors.Errorf("failed to find page %d in stream at %d", meta.id, meta.seek)
+		}
+		// Only part of the stream is cached. Another read may be loading
+		// a different part, in which case drop leaves it and it's waited
+		// for and dropped on the next pass.
+		wk.cache.drop(key)
+		id = -1
 	}
+}
 
-	return page{}, errors.Errorf("failed to find page after %d tries", maxTries)
+func findPage(pages []page, id int) (page, bool) {
+	for _, p := range pages {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return page{}, false
 }
 
-func fetchArticle(name string) (indexEntry, error) {
-	mu.Lock()
-	defer mu.Unlock()
+// readStream decodes every page in the stream at seek.
+func (wk *wiki) readStream(seek int) ([]page, error) {
+	return wk.readStreamUntil(wk.snapshot(), seek, -1)
+}
 
-	articleMeta, ok := mu.offsets[cityhash.Hash64([]byte(name))]
-	if ok {
-		return articleMeta, nil
-	}
-	articleMeta, ok = mu.offsets[cityhash.Hash64([]byte(strings.Title(strings.ToLower(name))))]
-	if ok {
-		return articleMeta, nil
+// readStreamUntil decodes the pages in the stream at seek in s up to and
+// including the one with the given ID, or all of them if it isn't there.
+func (wk *wiki) readStreamUntil(s *snapshot, seek, id int) ([]page, error) {
+	r, c, err := wk.openStream(s, seek)
+	if err != nil {
+		return nil, err
 	}
-	return indexEntry{}, statusErrorf(http.StatusNotFound, "article not found: %q", name)
-}
+	defer c.Close()
+
+	maxTries := s.titles.streamSize(seek)
 
-func randomArticleHash() (uint64, error) {
-	mu.Lock()
-	defer mu.Unlock()
+	d := xml.NewDecoder(r)
 
-	for hash := range mu.offsets {
-		return hash, nil
+	pages := make([]page, 0, maxTries)
+	for len(pages) < maxTries {
+		var p page
+		if err := d.Decode(&p); err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+		if p.ID == id {
+			break
+		}
 	}
-	return 0, errors.Errorf("no articles")
+	return pages, nil
 }
 
-func randomArticle() (page, error) {
-	hash, err := randomArticleHash()
+// fetchPage looks up and reads the page with the given title.
+func (wk *wiki) fetchPage(name string) (page, error) {
+	articleMeta, err := wk.fetchArticle(name)
 	if err != nil {
 		return page{}, err
 	}
+	return wk.readArticle(articleMeta)
+}
 
-	mu.Lock()
-	meta := mu.offsets[hash]
-	mu.Unlock()
-
-	return readArticle(meta)
+func (wk *wiki) fetchArticle(name string) (indexEntry, error) {
+	s := wk.snapshot()
+	articleMeta, ok := s.titles.lookup(s.namespaces.normalize(name))
+	if ok {
+		return articleMeta, nil
+	}
+	return indexEntry{}, statusErrorf(http.StatusNotFound, "article not found: %q", name)
 }
 
 type statusError int
@@ -293,7 +321,9 @@ func statusErrorf(code int, str string, args ...interface{}) error {
 	return errors.Wrapf(statusError(code), str, args...)
 }
 
-func errorHandler(f func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+// errorHandler renders errors returned by f as an error page of wk, which may
+// be nil for pages that don't belong to a wiki.
+func (wk *wiki) errorHandler(f func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
 			cause := errors.Cause(err)
@@ -301,88 +331,190 @@ func errorHandler(f func(w http.ResponseWriter, r *http.Request) error) http.Han
 			if cause, ok := cause.(statusError); ok {
 				status = int(cause)
 			}
+			// The status has to be sent before any of the body.
+			w.WriteHeader(status)
 			if err := executeTemplate(w, "error.html", struct {
+				pageData
 				Title, Error string
 			}{
-				Title: err.Error(),
-				Error: fmt.Sprintf("%+v", err),
+				pageData: wk.pageData(),
+				Title:    err.Error(),
+				Error:    fmt.Sprintf("%+v", err),
 			}); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				log.Printf("rendering error page: %+v", err)
 			}
-			w.WriteHeader(status)
 		}
 	}
+}
 
+// requestTitle returns the title from a request path under prefix. Titles may
+// contain slashes so everything after the prefix is used.
+func requestTitle(r *http.Request, prefix string) string {
+	return wikitext.URLToTitle(strings.TrimPrefix(r.URL.Path, prefix))
 }
 
-func handleArticle(w http.ResponseWriter, r *http.Request) error {
-	articleName := wikitext.URLToTitle(path.Base(r.URL.Path))
+func (wk *wiki) handleArticle(w http.ResponseWriter, r *http.Request) error {
+	articleName := requestTitle(r, wk.base()+"/wiki/")
 
-	if articleName == "Special:Random" {
-		article, err := randomArticle()
-		if err != nil {
-			return err
+	if special, ok := wk.namespaces().special(articleName); ok {
+		return wk.handleSpecial(w, r, special)
+	}
+
+	if other, title, ok := wk.interwiki(articleName); ok {
+		u := other.articleURL(title)
+		if title == "" {
+			u = other.articleURL(other.mainPage())
 		}
-		http.Redirect(w, r, path.Join("/wiki/", wikitext.TitleToURL(article.Title)), http.StatusTemporaryRedirect)
+		http.Redirect(w, r, u, http.StatusFound)
 		return nil
 	}
 
-	articleMeta, err := fetchArticle(articleName)
+	p, err := wk.fetchPage(articleName)
+	if isNotFound(err) {
+		// Like MediaWiki, categories with members but no page of their own
+		// still list their members.
+		title := wk.namespaces().normalize(articleName)
+		if ns, _ := wk.namespaces().split(title); ns == nsCategory && wk.categories() != nil && wk.categories().hasMembers(title) {
+			p, err = page{Title: title, NS: nsCategory}, nil
+		}
+	}
 	if err != nil {
 		return err
 	}
 
-	p, err := readArticle(articleMeta)
-	if err != nil {
-		return err
+	if r.FormValue("redirect") != "no" && p.isRedirect() {
+		target, fragment, err := wk.followRedirects(p)
+		if err == nil {
+			u := wk.articleURL(target.Title) + "?redirectedfrom=" + url.QueryEscape(p.Title)
+			if fragment != "" {
+				u += "#" + fragmentID(fragment)
+			}
+			http.Redirect(w, r, u, http.StatusFound)
+			return nil
+		}
+		// Like MediaWiki, redirects to missing pages show the redirect page
+		// itself.
+		if !isNotFound(err) {
+			return err
+		}
 	}
 
 	if p.Title != articleName {
-		http.Redirect(w, r, path.Join("/wiki/", wikitext.TitleToURL(p.Title)), http.StatusTemporaryRedirect)
+		u := wk.articleURL(p.Title)
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
 		return nil
 	}
 
-	body, err := wikitext.Convert(
-		[]byte(p.Text),
-		wikitext.TemplateHandler(p.templateHandler),
-	)
+	var redirectedFrom *link
+	if from := r.FormValue("redirectedfrom"); from != "" {
+		redirectedFrom = &link{
+			Title: from,
+			URL:   wk.articleURL(from) + "?redirect=no",
+		}
+	}
+
+	body, err := wk.renderPage(p)
 	if err != nil {
 		return err
 	}
-	if err := executeTemplate(w, "article.html", struct {
-		Title string
-		Body  template.HTML
-	}{
-		Title: articleName,
-		Body:  template.HTML(body),
+	var listing *categoryListing
+	if p.NS == nsCategory {
+		listing = wk.categoryListing(p.Title, r)
+	}
+	if err := executeTemplate(w, "article.html", articlePage{
+		pageData:        wk.pageData(),
+		Title:           articleName,
+		Body:            template.HTML(body),
+		RedirectedFrom:  redirectedFrom,
+		RedirectTo:      wk.redirectLink(p),
+		Categories:      wk.categoryLinks(p),
+		CategoryListing: listing,
 	}); err != nil {
 		return err
 	}
 	return nil
 }
 
-func handleSource(w http.ResponseWriter, r *http.Request) error {
-	articleName := wikitext.URLToTitle(path.Base(r.URL.Path))
-
-	articleMeta, err := fetchArticle(articleName)
-	if err != nil {
-		return err
+// redirectLink returns a link to the target of p if it's a redirect.
+func (wk *wiki) redirectLink(p page) *link {
+	target, fragment, ok := p.redirectTarget()
+	if !ok {
+		return nil
 	}
-	p, err := readArticle(articleMeta)
+	l := &link{
+		Title: target,
+		URL:   wk.articleURL(target),
+	}
+	if fragment != "" {
+		l.Title += "#" + fragment
+		l.URL += "#" + fragmentID(fragment)
+	}
+	return l
+}
+
+// articlePage is the data for article.html.
+type articlePage struct {
+	pageData
+	Title                      string
+	Body                       template.HTML
+	RedirectedFrom, RedirectTo *link
+	Categories                 []link
+	CategoryListing            *categoryListing
+}
+
+// renderPage converts the wikitext of p to HTML. Category links are left out
+// since they're listed separately.
+func (wk *wiki) renderPage(p page) ([]byte, error) {
+	return wikitext.Convert(
+		[]byte(p.Text),
+		wikitext.TemplateHandler(wikiPage{p, wk}.templateHandler),
+		wikitext.LinkFilter(func(target string) bool {
+			return !wk.isCategoryLink(target)
+		}),
+	)
+}
+
+// link is a link to an article for use in templates.
+type link struct {
+	Title, URL string
+}
+
+func (wk *wiki) handleSource(w http.ResponseWriter, r *http.Request) error {
+	articleName := requestTitle(r, wk.base()+"/source/")
+
+	p, err := wk.fetchPage(articleName)
 	if err != nil {
 		return err
 	}
-	return executeTemplate(w, "source.html", p)
+	return executeTemplate(w, "source.html", struct {
+		pageData
+		page
+	}{
+		pageData: wk.pageData(),
+		page:     p,
+	})
 }
 
-func handleIndex(w http.ResponseWriter, r *http.Request) error {
-	http.Redirect(w, r, "/wiki/Main_Page", http.StatusTemporaryRedirect)
+func (wk *wiki) handleIndex(w http.ResponseWriter, r *http.Request) error {
+	http.Redirect(w, r, wk.articleURL(wk.mainPage()), http.StatusTemporaryRedirect)
 	return nil
 }
 
 func main() {
+	flag.Usage = usage
 	if err := run(); err != nil {
+		switch errors.Cause(err).(type) {
+		case usageError:
+			fmt.Fprintf(os.Stderr, "%v\n\n", err)
+			flag.Usage()
+			os.Exit(2)
+		case statusError:
+			// Errors like missing pages don't need a stack trace.
+			log.Fatal(err)
+		}
 		log.Fatalf("%+v", err)
 	}
 }
@@ -390,21 +522,76 @@ func main() {
 func run() error {
 	flag.Parse()
 	log.SetFlags(log.Flags() | log.Lshortfile)
+	rand.Seed(time.Now().UnixNano())
+
+	cmd, args := "serve", flag.Args()
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	c, ok := findCommand(cmd)
+	if !ok {
+		return usageErrorf("unknown command %q", cmd)
+	}
+	// Flags may also be given after the command.
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
 
-	go func() {
-		if err := loadIndex(); err != nil {
-			log.Fatalf("%+v", err)
+	if len(wikiFlags) == 0 {
+		wk := newWiki("", *articlesFile, *indexFile)
+		wk.indexCacheFile = *indexCacheFile
+		wk.searchIndexFile = *searchIndexFile
+		wikis = append(wikis, wk)
+	}
+	for _, s := range wikiFlags {
+		wk, err := parseWikiFlag(s)
+		if err != nil {
+			return err
 		}
-	}()
+		for _, other := range wikis {
+			if other.name == wk.name {
+				return errors.Errorf("wiki %q given more than once", wk.name)
+			}
+		}
+		wikis = append(wikis, wk)
+	}
+
+	return c.run(flag.Args())
+}
+
+// rootHandlers serve the top level paths that don't belong to any wiki.
+var rootHandlers = map[string]http.Handler{
+	"/static/": http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))),
+	"/healthz": http.HandlerFunc(handleHealthz),
+	"/readyz":  http.HandlerFunc(handleReadyz),
+}
 
+// serveCommand runs the HTTP server, which loads the indexes in the
+// background.
+func serveCommand(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("serve takes no arguments")
+	}
 	if err := loadTemplates(); err != nil {
 		return err
 	}
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
-	http.HandleFunc("/source/", errorHandler(handleSource))
-	http.HandleFunc("/wiki/", errorHandler(handleArticle))
-	http.HandleFunc("/", errorHandler(handleIndex))
+	for path, h := range rootHandlers {
+		http.Handle(path, h)
+	}
+	if len(wikiFlags) > 0 {
+		http.HandleFunc("/", (*wiki)(nil).errorHandler(handleWikis))
+	}
+	for _, wk := range wikis {
+		wk.cache = newStreamCache(int64(*cacheSize) << 20)
+		wk.handle(http.DefaultServeMux)
+
+		go func(wk *wiki) {
+			if err := wk.loadIndex(); err != nil {
+				log.Fatalf("%s: %+v", wk.name, err)
+			}
+		}(wk)
+	}
 
 	log.Printf("Listening on %s...", *httpAddr)
 	return http.ListenAndServe(*httpAddr, nil)
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Namespace IDs that wikigopher needs to know about. These are the same on
+// every wiki, only their names differ.
+const (
+	nsSpecial  = -1
+	nsMain     = 0
+	nsFile     = 6
+	nsTemplate = 10
+	nsCategory = 14
+	nsModule   = 828
+)
+
+// canonicalNamespaces are MediaWiki's canonical namespace names by ID. They
+// are accepted on every wiki in addition to the local names from the dump.
+var canonicalNamespaces = map[int]string{
+	-2:  "Media",
+	-1:  "Special",
+	0:   "",
+	1:   "Talk",
+	2:   "User",
+	3:   "User talk",
+	4:   "Project",
+	5:   "Project talk",
+	6:   "File",
+	7:   "File talk",
+	8:   "MediaWiki",
+	9:   "MediaWiki talk",
+	10:  "Template",
+	11:  "Template talk",
+	12:  "Help",
+	13:  "Help talk",
+	14:  "Category",
+	15:  "Category talk",
+	828: "Module",
+	829: "Module talk",
+}
+
+// namespaceAliases are alternate names MediaWiki accepts for namespaces.
+var namespaceAliases = map[string]int{
+	"Image":      6,
+	"Image talk": 7,
+}
+
+// namespaceTable maps between namespace IDs and names for a wiki.
+type namespaceTable struct {
+	// names are the local names used in titles.
+	names map[int]string
+	// ids maps lower cased local names, canonical names and aliases to IDs.
+	ids map[string]int
+	// caseSensitive is set for namespaces where the first letter of titles
+	// isn't uppercased.
+	caseSensitive map[int]bool
+}
+
+func newNamespaceTable(info siteInfo) *namespaceTable {
+	t := &namespaceTable{
+		names:         map[int]string{},
+		ids:           map[string]int{},
+		caseSensitive: map[int]bool{},
+	}
+	for id, name := range canonicalNamespaces {
+		t.names[id] = name
+		t.ids[strings.ToLower(name)] = id
+	}
+	for name, id := range namespaceAliases {
+		t.ids[strings.ToLower(name)] = id
+	}
+	for _, ns := range info.Namespaces {
+		t.names[ns.Key] = ns.Name
+		t.ids[strings.ToLower(ns.Name)] = ns.Key
+		if ns.Case == "case-sensitive" {
+			t.caseSensitive[ns.Key] = true
+		}
+	}
+	delete(t.ids, "")
+	return t
+}
+
+// lookup returns the ID of the namespace with the given name, ignoring case.
+func (t *namespaceTable) lookup(name string) (int, bool) {
+	id, ok := t.ids[strings.ToLower(strings.Replace(name, "_", " ", -1))]
+	return id, ok
+}
+
+// split returns the namespace ID of title and the title without the namespace
+// prefix.
+func (t *namespaceTable) split(title string) (int, string) {
+	i := strings.IndexByte(title, ':')
+	if i < 0 {
+		return nsMain, title
+	}
+	id, ok := t.lookup(title[:i])
+	if !ok {
+		return nsMain, title
+	}
+	return id, title[i+1:]
+}
+
+// prefix returns the prefix of titles in namespace ns including the colon, or
+// "" for the main namespace.
+func (t *namespaceTable) prefix(ns int) string {
+	name := t.names[ns]
+	if name == "" {
+		return ""
+	}
+	return name + ":"
+}
+
+// parse parses a namespace given either by ID or by name.
+func (t *namespaceTable) parse(s string) (int, bool) {
+	if id, ok := t.lookup(s); ok {
+		return id, true
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	_, ok := t.names[id]
+	return id, ok
+}
+
+// special returns the name of the special page title refers to, if any.
+func (t *namespaceTable) special(title string) (string, bool) {
+	ns, name := t.split(t.normalize(title))
+	return name, ns == nsSpecial
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+const dewikiSiteInfo = `<siteinfo>
+    <sitename>Wikipedia</sitename>
+    <dbname>dewiki</dbname>
+    <base>https://de.wikipedia.org/wiki/Wikipedia:Hauptseite</base>
+    <generator>MediaWiki 1.32.0-wmf.6</generator>
+    <case>first-letter</case>
+    <namespaces>
+      <namespace key="-1" case="first-letter">Spezial</namespace>
+      <namespace key="0" case="first-letter" />
+      <namespace key="4" case="first-letter">Wikipedia</namespace>
+      <namespace key="6" case="first-letter">Datei</namespace>
+      <namespace key="10" case="first-letter">Vorlage</namespace>
+      <namespace key="14" case="first-letter">Kategorie</namespace>
+      <namespace key="828" case="first-letter">Modul</namespace>
+      <namespace key="2300" case="case-sensitive">Gadget</namespace>
+    </namespaces>
+  </siteinfo>`
+
+func TestNamespaceTable(t *testing.T) {
+	var info siteInfo
+	if err := xml.Unmarshal([]byte(dewikiSiteInfo), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.DBName != "dewiki" || len(info.Namespaces) != 8 {
+		t.Fatalf("unexpected siteinfo %+v", info)
+	}
+
+	namespaces := newNamespaceTable(info)
+
+	cases := []struct {
+		in, want string
+		ns       int
+	}{
+		{"Vorlage:Infobox", "Vorlage:Infobox", nsTemplate},
+		{"vorlage:infobox", "Vorlage:Infobox", nsTemplate},
+		{"Template:Infobox", "Vorlage:Infobox", nsTemplate},
+		{"Module:Arguments", "Modul:Arguments", nsModule},
+		{"image:Foo.jpg", "Datei:Foo.jpg", nsFile},
+		{"Category:Foo", "Kategorie:Foo", nsCategory},
+		{"Project:Hauptseite", "Wikipedia:Hauptseite", 4},
+		{"Special:Random", "Spezial:Random", nsSpecial},
+		{"gadget:foo", "Gadget:foo", 2300},
+		{"berlin", "Berlin", nsMain},
+	}
+	for _, c := range cases {
+		got := namespaces.normalize(c.in)
+		if got != c.want {
+			t.Errorf("normalize(%q) = %q; not %q", c.in, got, c.want)
+		}
+		if ns, _ := namespaces.split(got); ns != c.ns {
+			t.Errorf("split(%q) = %d; not %d", got, ns, c.ns)
+		}
+	}
+
+	if name, ok := namespaces.special("Spezial:Search"); !ok || name != "Search" {
+		t.Errorf("special(%q) = %q, %t", "Spezial:Search", name, ok)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxRedirects is the longest chain of redirects that will be followed.
+const maxRedirects = 5
+
+var redirectRegexp = regexp.MustCompile(`(?i)^\s*#REDIRECT\s*:?\s*\[\[([^\]|]+)`)
+
+func (p page) isRedirect() bool {
+	return len(p.Redirect) > 0
+}
+
+// redirectTarget returns the title and section a redirect page points to.
+// The dump's <redirect> element doesn't include the section so it's taken
+// from the #REDIRECT link in the text.
+func (p page) redirectTarget() (title, fragment string, ok bool) {
+	if !p.isRedirect() {
+		return "", "", false
+	}
+	title = p.Redirect[0].Title
+	if m := redirectRegexp.FindStringSubmatch(p.Text); m != nil {
+		if i := strings.IndexByte(m[1], '#'); i >= 0 {
+			fragment = strings.TrimSpace(m[1][i+1:])
+		}
+	}
+	return title, fragment, true
+}
+
+// followRedirects follows the chain of redirects starting at p and returns the
+// final page along with the section to jump to, if any. It fails if the chain
+// loops or is longer than maxRedirects. If a target doesn't exist the error
+// has a 404 status.
+func (wk *wiki) followRedirects(p page) (page, string, error) {
+	namespaces := wk.namespaces()
+	chain := []string{p.Title}
+	seen := map[string]bool{namespaces.normalize(p.Title): true}
+	var fragment string
+	for {
+		target, targetFragment, ok := p.redirectTarget()
+		if !ok {
+			return p, fragment, nil
+		}
+		if len(chain) > maxRedirects {
+			return page{}, "", statusErrorf(http.StatusLoopDetected, "more than %d redirects: %s", maxRedirects, strings.Join(chain, " → "))
+		}
+		chain = append(chain, target)
+		key := namespaces.normalize(target)
+		if seen[key] {
+			return page{}, "", statusErrorf(http.StatusLoopDetected, "redirect loop: %s", strings.Join(chain, " → "))
+		}
+		seen[key] = true
+
+		meta, err := wk.fetchArticle(target)
+		if err != nil {
+			return page{}, "", errors.Wrapf(err, "following redirect from %q", p.Title)
+		}
+		next, err := wk.readArticle(meta)
+		if err != nil {
+			return page{}, "", err
+		}
+		if targetFragment != "" {
+			fragment = targetFragment
+		}
+		p = next
+	}
+}
+
+// isNotFound reports whether err is a 404 from statusErrorf.
+func isNotFound(err error) bool {
+	status, ok := errors.Cause(err).(statusError)
+	return ok && int(status) == http.StatusNotFound
+}
+
+// fragmentID converts a section name into the anchor MediaWiki uses for it.
+func fragmentID(fragment string) string {
+	return strings.Replace(fragment, " ", "_", -1)
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestRedirectTarget(t *testing.T) {
+	cases := []struct {
+		p              page
+		title, section string
+		ok             bool
+	}{
+		{
+			page{Title: "Foo", Text: "Foo is a thing."},
+			"", "", false,
+		},
+		{
+			page{
+				Title:    "AccessibleComputing",
+				Redirect: []redirect{{Title: "Computer accessibility"}},
+				Text:     "#REDIRECT [[Computer accessibility]]\n\n{{R from CamelCase}}",
+			},
+			"Computer accessibility", "", true,
+		},
+		{
+			page{
+				Title:    "Foo history",
+				Redirect: []redirect{{Title: "Foo"}},
+				Text:     "#redirect: [[Foo#Early history|history]]",
+			},
+			"Foo", "Early history", true,
+		},
+	}
+	for _, c := range cases {
+		title, section, ok := c.p.redirectTarget()
+		if title != c.title || section != c.section || ok != c.ok {
+			t.Errorf("%q.redirectTarget() = %q, %q, %t; not %q, %q, %t", c.p.Title, title, section, ok, c.title, c.section, c.ok)
+		}
+	}
+}
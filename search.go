@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/d4l3k/wikigopher/wikitext"
+	"github.com/pkg/errors"
+)
+
+const searchPageSize = 20
+
+// Internal keys used to track title indexing in the search index so it can be
+// resumed after a restart.
+var (
+	titlesSourceKey = []byte("titles/source")
+	titlesLastKey   = []byte("titles/last")
+	titlesDoneKey   = []byte("titles/done")
+
+	textSourceKey     = []byte("text/source")
+	textCheckpointKey = []byte("text/checkpoint")
+)
+
+// titleDoc is the search document stored for every title. The document ID is
+// the title itself.
+type titleDoc struct {
+	Title string
+}
+
+// pageDoc replaces the titleDoc for articles once their text has been
+// indexed.
+type pageDoc struct {
+	Title, Text string
+}
+
+// loadSearchIndex opens the search index, creating it if -search is set and
+// it doesn't exist yet. With -search any titles that haven't been indexed are
+// added.
+func (wk *wiki) loadSearchIndex() error {
+	index, err := bleve.Open(wk.searchIndexFile)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		if !*search {
+			log.Printf("No search index at %q, run with -search to build it", wk.searchIndexFile)
+			return nil
+		}
+		index, err = bleve.New(wk.searchIndexFile, bleve.NewIndexMapping())
+	}
+	if err != nil {
+		return err
+	}
+
+	stale, err := wk.searchIndexStale(index)
+	if err != nil {
+		index.Close()
+		return err
+	}
+	if stale {
+		if !*search {
+			index.Close()
+			log.Printf("Search index at %q is from another dump, run with -search to rebuild it", wk.searchIndexFile)
+			return nil
+		}
+		// Documents of titles that are gone would be left behind by
+		// reindexing, so start over.
+		log.Printf("Search index at %q is from another dump, rebuilding it", wk.searchIndexFile)
+		if err := index.Close(); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(wk.searchIndexFile); err != nil {
+			return err
+		}
+		if index, err = bleve.New(wk.searchIndexFile, bleve.NewIndexMapping()); err != nil {
+			return err
+		}
+	}
+
+	wk.updateSnapshot(func(s *snapshot) {
+		s.index = index
+	})
+	titles := wk.titles()
+
+	if !*search {
+		return nil
+	}
+	if err := wk.indexTitles(index, titles); err != nil {
+		return err
+	}
+	if !*fullText {
+		return nil
+	}
+	return wk.indexText(index, titles)
+}
+
+// indexSource identifies the files the title index was built from so the
+// search index can tell when it needs to be rebuilt.
+func (wk *wiki) indexSource() (string, error) {
+	s := wk.snapshot()
+	paths := []string{wk.titleSource()}
+	for _, dump := range s.incremental {
+		paths = append(paths, dump.path)
+	}
+	paths = append(paths, s.deletionLogs...)
+	var sources []string
+	for _, path := range paths {
+		source, err := fileSource(path)
+		if err != nil {
+			return "", err
+		}
+		sources = append(sources, source)
+	}
+	return strings.Join(sources, ","), nil
+}
+
+// textSource identifies the files the article text in the search index is
+// read from, which includes the incremental dumps applied to the articles.
+func (wk *wiki) textSource() (string, error) {
+	articles, err := fileSource(wk.articlesFile)
+	if err != nil {
+		return "", err
+	}
+	source, err := wk.indexSource()
+	if err != nil {
+		return "", err
+	}
+	return articles + "," + source, nil
+}
+
+func fileSource(path string) (string, error) {
+	source, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", source.Size(), source.ModTime().UnixNano()), nil
+}
+
+// searchIndexStale reports whether index holds titles or article text from a
+// different dump than the one loaded.
+func (wk *wiki) searchIndexStale(index bleve.Index) (bool, error) {
+	source, err := wk.indexSource()
+	if err != nil {
+		return false, err
+	}
+	textSource, err := wk.textSource()
+	if err != nil {
+		return false, err
+	}
+	for key, source := range map[string]string{
+		string(titlesSourceKey): source,
+		string(textSourceKey):   textSource,
+	} {
+		prevSource, err := index.GetInternal([]byte(key))
+		if err != nil {
+			return false, err
+		}
+		if len(prevSource) > 0 && string(prevSource) != source {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// indexTitles adds every title to the search index. Progress is stored in the
+// index after every batch so an interrupted run picks up where it left off.
+func (wk *wiki) indexTitles(index bleve.Index, titles *titleIndex) error {
+	source, err := wk.indexSource()
+	if err != nil {
+		return err
+	}
+	done, err := index.GetInternal(titlesDoneKey)
+	if err != nil {
+		return err
+	}
+	if string(done) == source {
+		log.Printf("Search index is up to date")
+		return nil
+	}
+
+	var from string
+	prevSource, err := index.GetInternal(titlesSourceKey)
+	if err != nil {
+		return err
+	}
+	if string(prevSource) == source {
+		last, err := index.GetInternal(titlesLastKey)
+		if err != nil {
+			return err
+		}
+		// Resume after the last title that was indexed.
+		if len(last) > 0 {
+			from = string(last) + "\x00"
+		}
+	} else if err := index.SetInternal(titlesSourceKey, []byte(source)); err != nil {
+		return err
+	}
+
+	log.Printf("Indexing titles from %q...", from)
+	i := 0
+	batch := index.NewBatch()
+	var batchErr error
+	titles.ascend(from, func(title string, entry indexEntry) bool {
+		if batchErr = batch.Index(title, titleDoc{Title: title}); batchErr != nil {
+			return false
+		}
+		i++
+		if i%10000 == 0 {
+			batch.SetInternal(titlesLastKey, []byte(title))
+			if batchErr = index.Batch(batch); batchErr != nil {
+				return false
+			}
+			batch.Reset()
+		}
+		if i%100000 == 0 {
+			log.Printf("indexed %d titles", i)
+		}
+		return true
+	})
+	if batchErr != nil {
+		return batchErr
+	}
+	batch.SetInternal(titlesDoneKey, []byte(source))
+	if err := index.Batch(batch); err != nil {
+		return err
+	}
+	log.Printf("Done indexing titles!")
+	return nil
+}
+
+// indexText crawls every stream in the articles file and indexes the plain
+// text of each article. The offset of the last fully indexed stream is stored
+// in the index so the crawl resumes from there after a restart.
+func (wk *wiki) indexText(index bleve.Index, titles *titleIndex) error {
+	source, err := wk.textSource()
+	if err != nil {
+		return err
+	}
+	namespaces := wk.namespaces()
+	streams := titles.streams()
+
+	prevSource, err := index.GetInternal(textSourceKey)
+	if err != nil {
+		return err
+	}
+	if string(prevSource) == source {
+		checkpoint, err := index.GetInternal(textCheckpointKey)
+		if err != nil {
+			return err
+		}
+		if len(checkpoint) > 0 {
+			seek, err := strconv.Atoi(string(checkpoint))
+			if err != nil {
+				return errors.Wrapf(err, "parsing checkpoint")
+			}
+			streams = streamsAfter(streams, seek)
+		}
+	} else {
+		if err := index.SetInternal(textCheckpointKey, nil); err != nil {
+			return err
+		}
+		if err := index.SetInternal(textSourceKey, []byte(source)); err != nil {
+			return err
+		}
+	}
+	if len(streams) == 0 {
+		log.Printf("Article text index is up to date")
+		return nil
+	}
+
+	log.Printf("Indexing article text in %d streams...", len(streams))
+	i := 0
+	if err := wk.walkStreams(streams, *fullTextWorkers, func(seek int, pages []page) error {
+		batch := index.NewBatch()
+		for _, p := range pages {
+			if p.NS != 0 || len(p.Redirect) > 0 {
+				continue
+			}
+			// Skip pages that have been replaced by an incremental dump or
+			// deleted.
+			entry, ok := titles.lookup(namespaces.normalize(p.Title))
+			if !ok || entry.id != p.ID || entry.seek != seek {
+				continue
+			}
+			if err := batch.Index(p.Title, pageDoc{
+				Title: p.Title,
+				Text:  wikitext.PlainText([]byte(p.Text)),
+			}); err != nil {
+				return err
+			}
+		}
+		return index.Batch(batch)
+	}, func(seek int) error {
+		i++
+		if i%1000 == 0 {
+			log.Printf("indexed text of %d/%d streams", i, len(streams))
+		}
+		return index.SetInternal(textCheckpointKey, []byte(strconv.Itoa(seek)))
+	}); err != nil {
+		return err
+	}
+	log.Printf("Done indexing article text!")
+	return nil
+}
+
+type searchResult struct {
+	Title, URL string
+	Snippet    template.HTML
+}
+
+// handleSearch serves /search and Special:Search. Queries that exactly match a
+// title redirect straight to the article.
+func (wk *wiki) handleSearch(w http.ResponseWriter, r *http.Request) error {
+	query := strings.TrimSpace(r.FormValue("q"))
+	if query == "" {
+		query = strings.TrimSpace(r.FormValue("search"))
+	}
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	if query != "" && r.FormValue("fulltext") == "" {
+		if _, err := wk.fetchArticle(query); err == nil {
+			http.Redirect(w, r, wk.articleURL(query), http.StatusTemporaryRedirect)
+			return nil
+		}
+	}
+
+	index := wk.snapshot().index
+
+	data := struct {
+		pageData
+		Title, Query string
+		Disabled     bool
+		Results      []searchResult
+		Total        uint64
+		From, To     int
+		Prev, Next   string
+	}{
+		pageData: wk.pageData(),
+		Title:    "Search",
+		Query:    query,
+		Disabled: index == nil,
+	}
+
+	if query != "" && index != nil {
+		titleQuery := bleve.NewMatchQuery(query)
+		titleQuery.SetField("Title")
+		titleQuery.SetBoost(3)
+		textQuery := bleve.NewMatchQuery(query)
+		textQuery.SetField("Text")
+		req := bleve.NewSearchRequestOptions(
+			bleve.NewDisjunctionQuery(titleQuery, textQuery),
+			searchPageSize, offset, false,
+		)
+		req.Highlight = bleve.NewHighlight()
+		req.Highlight.AddField("Text")
+		res, err := index.Search(req)
+		if err != nil {
+			return err
+		}
+		data.Total = res.Total
+		data.From = offset + 1
+		data.To = offset + len(res.Hits)
+		for _, hit := range res.Hits {
+			var snippets []string
+			for _, fragment := range hit.Fragments["Text"] {
+				snippets = append(snippets, snippetHTML(fragment))
+			}
+			data.Results = append(data.Results, searchResult{
+				Title:   hit.ID,
+				URL:     wk.articleURL(hit.ID),
+				Snippet: template.HTML(strings.Join(snippets, " … ")),
+			})
+		}
+		if offset > 0 {
+			data.Prev = wk.searchURL(query, offset-searchPageSize)
+		}
+		if uint64(offset+searchPageSize) < res.Total {
+			data.Next = wk.searchURL(query, offset+searchPageSize)
+		}
+	}
+
+	return executeTemplate(w, "search.html", data)
+}
+
+var markRegexp = regexp.MustCompile(`</?mark>`)
+
+// snippetHTML returns the HTML for a fragment from the highlighter. It only
+// wraps matches in <mark> and doesn't escape the stored text, which is plain
+// text with entities already decoded, so everything else is escaped here.
+// Marks in the text itself are kept only while they're balanced.
+func snippetHTML(fragment string) string {
+	var b strings.Builder
+	open := false
+	last := 0
+	for _, m := range markRegexp.FindAllStringIndex(fragment, -1) {
+		b.WriteString(html.EscapeString(fragment[last:m[0]]))
+		last = m[1]
+		if end := fragment[m[0]+1] == '/'; end == open {
+			b.WriteString(fragment[m[0]:m[1]])
+			open = !end
+		}
+	}
+	b.WriteString(html.EscapeString(fragment[last:]))
+	if open {
+		b.WriteString("</mark>")
+	}
+	return b.String()
+}
+
+func (wk *wiki) searchURL(query string, offset int) string {
+	if offset < 0 {
+		offset = 0
+	}
+	return fmt.Sprintf("%s/search?fulltext=1&q=%s&offset=%d", wk.base(), url.QueryEscape(query), offset)
+}
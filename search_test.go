@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSearchIndexSourceChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := *search
+	defer func() { *search = old }()
+	*search = true
+
+	wk := loadTestWiki(t, dir)
+	wk.searchIndexFile = filepath.Join(dir, "index.bleve")
+	if err := wk.loadSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	index := wk.snapshot().index
+	if n, err := index.DocCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 300 {
+		t.Fatalf("indexed %d titles; not 300", n)
+	}
+
+	// Pretend the index was built from another dump that had a title this
+	// one doesn't.
+	if err := index.Index("Deleted page", titleDoc{Title: "Deleted page"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][]byte{titlesSourceKey, titlesDoneKey} {
+		if err := index.SetInternal(key, []byte("1:1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wk.loadSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	index = wk.snapshot().index
+	defer index.Close()
+	if n, err := index.DocCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 300 {
+		t.Errorf("index has %d documents after the source changed; not 300", n)
+	}
+	source, err := wk.indexSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done, err := index.GetInternal(titlesDoneKey); err != nil {
+		t.Fatal(err)
+	} else if string(done) != source {
+		t.Errorf("index is done for source %q; not %q", done, source)
+	}
+}
+
+func TestSearchIndexTextSourceChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := *search
+	defer func() { *search = old }()
+	*search = true
+
+	wk := loadTestWiki(t, dir)
+	wk.searchIndexFile = filepath.Join(dir, "index.bleve")
+	if err := wk.loadSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the text of an article from another dump was indexed.
+	index := wk.snapshot().index
+	if err := index.Index("Old article", pageDoc{Title: "Old article", Text: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.SetInternal(textSourceKey, []byte("1:1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wk.loadSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	index = wk.snapshot().index
+	defer index.Close()
+	if n, err := index.DocCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 300 {
+		t.Errorf("index has %d documents after the dump changed; not 300", n)
+	}
+	if source, err := index.GetInternal(textSourceKey); err != nil {
+		t.Fatal(err)
+	} else if len(source) > 0 {
+		t.Errorf("text source %q survived the rebuild", source)
+	}
+}
+
+func TestSearchSnippetEscaped(t *testing.T) {
+	old := *search
+	oldFullText := *fullText
+	defer func() { *search, *fullText = old, oldFullText }()
+	*search, *fullText = true, true
+
+	wk, dir := writeTestDump(t,
+		testPage(1, "Scripted", "a &lt; b &lt;script&gt;alert(1)&lt;/script&gt; zebra"),
+	)
+	defer os.RemoveAll(dir)
+	wk.searchIndexFile = filepath.Join(dir, "index.bleve")
+	if err := wk.loadSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	defer wk.snapshot().index.Close()
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := wk.handleSearch(w, httptest.NewRequest("GET", "/search?fulltext=1&q=zebra", nil)); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "<script>") || !strings.Contains(body, "a &lt; b") || !strings.Contains(body, "<mark>zebra</mark>") {
+		t.Errorf("snippet isn't escaped: %s", body)
+	}
+}
+
+func TestSnippetHTML(t *testing.T) {
+	cases := map[string]string{
+		"a <b> & <mark>c</mark>":        "a &lt;b&gt; &amp; <mark>c</mark>",
+		"</mark><script>x</script>":     "&lt;script&gt;x&lt;/script&gt;",
+		"<mark><mark>a</mark></mark> b": "<mark>a</mark> b",
+		"<mark>a":                       "<mark>a</mark>",
+	}
+	for fragment, want := range cases {
+		if got := snippetHTML(fragment); got != want {
+			t.Errorf("snippetHTML(%q) = %q; not %q", fragment, got, want)
+		}
+	}
+}
+
+func TestIndexTextSkipsReplacedPages(t *testing.T) {
+	old := *search
+	oldFullText := *fullText
+	defer func() { *search, *fullText = old, oldFullText }()
+	*search, *fullText = true, true
+
+	wk, dir := writeTestDump(t,
+		testPage(1, "Kept", "zebra"),
+		testPage(2, "Gone", "zebra"),
+	)
+	defer os.RemoveAll(dir)
+	wk.searchIndexFile = filepath.Join(dir, "index.bleve")
+
+	// Pretend "Gone" was deleted by an incremental dump.
+	kept, err := wk.fetchArticle("Kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := testTitleIndex(t, []string{"Kept"}, []indexEntry{kept})
+	idx.setStreamSizes(map[int]int{kept.seek: wk.titles().streamSize(kept.seek)})
+	before, err := wk.textSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wk.updateSnapshot(func(s *snapshot) {
+		s.titles = idx
+		s.incremental = []incrementalDump{{path: wk.articlesFile}}
+	})
+	if after, err := wk.textSource(); err != nil {
+		t.Fatal(err)
+	} else if after == before {
+		t.Errorf("text source %q doesn't change with the incremental dumps", after)
+	}
+
+	if err := wk.loadSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	index := wk.snapshot().index
+	defer index.Close()
+	if n, err := index.DocCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("indexed %d documents; not just the page that wasn't deleted", n)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Example:
+  <siteinfo>
+    <sitename>Wikipedia</sitename>
+    <dbname>enwiki</dbname>
+    <base>https://en.wikipedia.org/wiki/Main_Page</base>
+    <generator>MediaWiki 1.32.0-wmf.6</generator>
+    <case>first-letter</case>
+    <namespaces>
+      <namespace key="-2" case="first-letter">Media</namespace>
+      <namespace key="-1" case="first-letter">Special</namespace>
+      <namespace key="0" case="first-letter" />
+      <namespace key="1" case="first-letter">Talk</namespace>
+      ...
+    </namespaces>
+  </siteinfo>
+*/
+
+type siteInfo struct {
+	SiteName   string          `xml:"sitename"`
+	DBName     string          `xml:"dbname"`
+	Base       string          `xml:"base"`
+	Generator  string          `xml:"generator"`
+	Case       string          `xml:"case"`
+	Namespaces []namespaceInfo `xml:"namespaces>namespace"`
+}
+
+type namespaceInfo struct {
+	Key  int    `xml:"key,attr"`
+	Case string `xml:"case,attr"`
+	Name string `xml:",chardata"`
+}
+
+// readSiteInfo decodes the <siteinfo> block at the start of the articles
+// dump.
+func readSiteInfo(path string) (siteInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return siteInfo{}, err
+	}
+	defer f.Close()
+
+	r, err := openDump(f)
+	if err != nil {
+		return siteInfo{}, err
+	}
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return siteInfo{}, errors.Errorf("no <siteinfo> in %q", path)
+		} else if err != nil {
+			return siteInfo{}, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "siteinfo":
+			var info siteInfo
+			if err := d.DecodeElement(&info, &start); err != nil {
+				return siteInfo{}, err
+			}
+			return info, nil
+		case "page":
+			return siteInfo{}, errors.Errorf("no <siteinfo> before the first page in %q", path)
+		}
+	}
+}
+
+// loadSiteInfo reads the namespaces of the dump so titles can be normalized
+// with the wiki's local namespace names.
+func (wk *wiki) loadSiteInfo() error {
+	wk.status.setPhase("Reading siteinfo", 0)
+	info, err := readSiteInfo(wk.articlesFile)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded siteinfo for %s (%s) with %d namespaces", info.SiteName, info.DBName, len(info.Namespaces))
+
+	namespaces := newNamespaceTable(info)
+	wk.updateSnapshot(func(s *snapshot) {
+		s.site = info
+		s.namespaces = namespaces
+	})
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// handleSpecial serves the special page name, e.g. "Random/Template". Like
+// MediaWiki anything after a slash is an argument to the page.
+func (wk *wiki) handleSpecial(w http.ResponseWriter, r *http.Request, name string) error {
+	var arg string
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name, arg = name[:i], name[i+1:]
+	}
+	switch name {
+	case "Search":
+		return wk.handleSearch(w, r)
+	case "Random", "RandomPage":
+		return wk.handleRandom(w, r, arg, false)
+	case "RandomRedirect":
+		return wk.handleRandom(w, r, arg, true)
+	case "RandomInCategory":
+		return wk.handleRandomInCategory(w, r, arg)
+	case "WhatLinksHere":
+		return wk.handleWhatLinksHere(w, r, arg)
+	case "Export":
+		return wk.handleExport(w, r, arg)
+	case "AllPages":
+		return wk.handleAllPages(w, r, arg, false)
+	case "PrefixIndex":
+		return wk.handleAllPages(w, r, arg, true)
+	}
+	return statusErrorf(http.StatusNotFound, "no special page %q", name)
+}
+
+// handleRandom redirects to a random page in the namespace given by arg, the
+// main namespace by default.
+func (wk *wiki) handleRandom(w http.ResponseWriter, r *http.Request, arg string, redirect bool) error {
+	ns := nsMain
+	if arg != "" {
+		var ok bool
+		if ns, ok = wk.namespaces().parse(arg); !ok {
+			return statusErrorf(http.StatusNotFound, "unknown namespace %q", arg)
+		}
+	}
+	p, err := wk.randomArticle(ns, redirect)
+	if err != nil {
+		return err
+	}
+	u := wk.articleURL(p.Title)
+	if redirect {
+		u += "?redirect=no"
+	}
+	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+	return nil
+}
+
+const (
+	// randomPicks is how many titles are picked before giving up on finding
+	// one in the namespace.
+	randomPicks = 10000
+	// randomReads is how many pages in the namespace are read before giving
+	// up on finding one that is or isn't a redirect as asked.
+	randomReads = 100
+)
+
+// randomArticle picks a page in namespace ns uniformly at random among those
+// that are redirects, or aren't, depending on redirect. Whether a page is a
+// redirect isn't in the index so titles are picked until a matching one is
+// found.
+func (wk *wiki) randomArticle(ns int, redirect bool) (page, error) {
+	titles := wk.titles()
+	lo, hi := 0, titles.len()
+	// Titles in other namespaces are sorted together by their prefix, the
+	// main namespace is spread between them.
+	if prefix := wk.namespaces().prefix(ns); prefix != "" {
+		lo = titles.find(prefix)
+		hi = titles.find(prefix[:len(prefix)-1] + ";")
+	}
+	if lo >= hi {
+		return page{}, statusErrorf(http.StatusNotFound, "no pages in namespace %d", ns)
+	}
+
+	reads := 0
+	for i := 0; i < randomPicks && reads < randomReads; i++ {
+		_, entry := titles.titleAt(lo + rand.Intn(hi-lo))
+		if entry.ns != ns {
+			continue
+		}
+		reads++
+		p, err := wk.readArticle(entry)
+		if err != nil {
+			return page{}, err
+		}
+		if p.isRedirect() == redirect {
+			return p, nil
+		}
+	}
+	return page{}, statusErrorf(http.StatusNotFound, "no matching page found in namespace %d after %d reads", ns, reads)
+}
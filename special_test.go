@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestWiki loads testDump with its index file in dir.
+func loadTestWiki(t *testing.T, dir string) *wiki {
+	wk := newWiki("", testDump, "")
+	wk.indexCacheFile = filepath.Join(dir, "dump.xml.bz2.idx")
+	wk.cache = newStreamCache(1 << 20)
+	wk.format = wk.detectFormat()
+	if err := wk.loadSiteInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wk.loadTitleIndex(); err != nil {
+		t.Fatal(err)
+	}
+	return wk
+}
+
+func TestRandomArticle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wikigopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wk := loadTestWiki(t, dir)
+
+	for _, ns := range []int{nsMain, nsTemplate} {
+		seen := map[int]bool{}
+		for i := 0; i < 20; i++ {
+			p, err := wk.randomArticle(ns, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.NS != ns {
+				t.Errorf("picked %q in namespace %d; not %d", p.Title, p.NS, ns)
+			}
+			seen[p.ID] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("namespace %d: always picked the same page", ns)
+		}
+	}
+
+	// The dump has no redirects or modules.
+	if _, err := wk.randomArticle(nsMain, true); !isNotFound(err) {
+		t.Errorf("random redirect: got %v; not a 404", err)
+	}
+	if _, err := wk.randomArticle(nsModule, false); !isNotFound(err) {
+		t.Errorf("random module: got %v; not a 404", err)
+	}
+}
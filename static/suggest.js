@@ -0,0 +1,36 @@
+// Fills the search box's datalist with title suggestions as the user types.
+document.addEventListener('DOMContentLoaded', function() {
+  var form = document.querySelector('form.search');
+  var input = form && form.querySelector('input[name=q]');
+  var list = document.getElementById('search-suggestions');
+  if (!input || !list) {
+    return;
+  }
+
+  var pending = null;
+  input.addEventListener('input', function() {
+    var prefix = input.value;
+    if (pending) {
+      clearTimeout(pending);
+    }
+    pending = setTimeout(function() {
+      if (!prefix) {
+        list.innerHTML = '';
+        return;
+      }
+      fetch(form.dataset.suggest + '?prefix=' + encodeURIComponent(prefix))
+        .then(function(resp) { return resp.json(); })
+        .then(function(data) {
+          if (input.value !== prefix || !data.titles) {
+            return;
+          }
+          list.innerHTML = '';
+          data.titles.forEach(function(title) {
+            var option = document.createElement('option');
+            option.value = title;
+            list.appendChild(option);
+          });
+        });
+    }, 100);
+  });
+});
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// loadState tracks the progress of loading a wiki's index so requests made
+// while it is loading can be told to retry instead of getting a 404.
+type loadState struct {
+	mu sync.Mutex
+
+	ready bool
+	phase string
+	// entries is the number of index entries processed in the current phase
+	// and total the expected number, or 0 if it isn't known.
+	entries, total int
+}
+
+type loadProgress struct {
+	Ready          bool
+	Phase          string
+	Entries, Total int
+}
+
+// Percent returns how far through the current phase loading is, or -1 if the
+// total is unknown.
+func (p loadProgress) Percent() int {
+	if p.Total <= 0 {
+		return -1
+	}
+	return p.Entries * 100 / p.Total
+}
+
+func (p loadProgress) String() string {
+	if p.Ready {
+		return "ready"
+	}
+	if percent := p.Percent(); percent >= 0 {
+		return fmt.Sprintf("%s: %d/%d entries (%d%%)", p.Phase, p.Entries, p.Total, percent)
+	}
+	return fmt.Sprintf("%s: %d entries", p.Phase, p.Entries)
+}
+
+func (s *loadState) setPhase(phase string, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.phase = phase
+	s.entries = 0
+	s.total = total
+}
+
+func (s *loadState) setEntries(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = n
+}
+
+func (s *loadState) setReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ready = true
+	s.phase = "Ready"
+}
+
+func (s *loadState) progress() loadProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	phase := s.phase
+	if phase == "" {
+		phase = "Starting"
+	}
+	return loadProgress{
+		Ready:   s.ready,
+		Phase:   phase,
+		Entries: s.entries,
+		Total:   s.total,
+	}
+}
+
+// readyHandler shows a loading page with a 503 status until the index has
+// finished loading.
+func (wk *wiki) readyHandler(f func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		progress := wk.status.progress()
+		if progress.Ready {
+			return f(w, r)
+		}
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return executeTemplate(w, "loading.html", struct {
+			pageData
+			Title    string
+			Progress loadProgress
+		}{
+			pageData: wk.pageData(),
+			Title:    "Loading",
+			Progress: progress,
+		})
+	}
+}
+
+// handleHealthz reports that the server is up, whether or not the indexes
+// have loaded.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether every wiki has finished loading its index and
+// the server can serve articles.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready := true
+	progress := make([]loadProgress, len(wikis))
+	for i, wk := range wikis {
+		progress[i] = wk.status.progress()
+		ready = ready && progress[i].Ready
+	}
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for i, wk := range wikis {
+		if wk.name != "" {
+			fmt.Fprintf(w, "%s: ", wk.name)
+		}
+		fmt.Fprintln(w, progress[i])
+	}
+}
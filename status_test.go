@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestHandleReadyz(t *testing.T) {
+	old := wikis
+	defer func() { wikis = old }()
+	wk := newWiki("", "", "")
+	wikis = []*wiki{wk}
+
+	wk.status.setPhase("Loading index file", 200)
+	wk.status.setEntries(50)
+
+	w := httptest.NewRecorder()
+	handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("while loading got status %d; not %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if got, want := w.Body.String(), "Loading index file: 50/200 entries (25%)\n"; got != want {
+		t.Errorf("while loading got body %q; not %q", got, want)
+	}
+
+	wk.status.setReady()
+
+	w = httptest.NewRecorder()
+	handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("when ready got status %d; not %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestErrorHandlerStatus(t *testing.T) {
+	wk, dir := writeTestDump(t, testPage(1, "Page", "Text"))
+	defer os.RemoveAll(dir)
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{statusErrorf(http.StatusNotFound, "not found"), http.StatusNotFound},
+		{errors.Wrap(statusErrorf(http.StatusServiceUnavailable, "busy"), "reading"), http.StatusServiceUnavailable},
+		{errors.New("broken"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		handler := wk.errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+			return c.err
+		})
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/wiki/Page", nil))
+		if w.Code != c.want {
+			t.Errorf("%v: got status %d; not %d", c.err, w.Code, c.want)
+		}
+		if !strings.Contains(w.Body.String(), c.err.Error()) {
+			t.Errorf("%v: error page is missing the error: %s", c.err, w.Body)
+		}
+	}
+
+	// Not found articles go through the same path.
+	w := httptest.NewRecorder()
+	wk.errorHandler(wk.handleArticle)(w, httptest.NewRequest("GET", "/wiki/Missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing article got status %d; not %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 100
+)
+
+// prefixSearch returns up to limit titles starting with prefix in sorted
+// order. If filter is set only titles in namespace ns are returned and prefix
+// must already include the namespace.
+func (idx *titleIndex) prefixSearch(prefix string, ns int, filter bool, limit int) []string {
+	return idx.prefixSearchFrom(prefix, prefix, ns, filter, limit)
+}
+
+// prefixSearchFrom is like prefixSearch but starts at the first title greater
+// than or equal to from.
+func (idx *titleIndex) prefixSearchFrom(prefix, from string, ns int, filter bool, limit int) []string {
+	if from < prefix {
+		from = prefix
+	}
+	var titles []string
+	for i := idx.find(from); i < idx.len() && len(titles) < limit; {
+		title, entry := idx.titleAt(i)
+		if !strings.HasPrefix(title, prefix) {
+			break
+		}
+		if filter && ns == nsMain && entry.ns != nsMain {
+			// Skip past every title in the other namespace. ';' sorts
+			// directly after ':'.
+			i = idx.find(title[:strings.IndexByte(title, ':')] + ";")
+			continue
+		}
+		titles = append(titles, title)
+		i++
+	}
+	return titles
+}
+
+// suggest parses the common parameters of the suggestion APIs and returns the
+// matching titles.
+func (wk *wiki) suggest(r *http.Request, prefix string) ([]string, error) {
+	namespaces := wk.namespaces()
+
+	limit := defaultSuggestLimit
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return nil, statusErrorf(http.StatusBadRequest, "invalid limit %q", s)
+		}
+		if limit > maxSuggestLimit {
+			limit = maxSuggestLimit
+		}
+	}
+
+	var ns int
+	var filter bool
+	if s := r.FormValue("namespace"); s != "" {
+		var ok bool
+		ns, ok = namespaces.parse(s)
+		if !ok {
+			return nil, statusErrorf(http.StatusBadRequest, "unknown namespace %q", s)
+		}
+		filter = true
+	}
+
+	// Keep a trailing space so "Foo " only matches "Foo bar" and not "Foobar".
+	trailingSpace := strings.HasSuffix(collapseSpaces(prefix), " ")
+	prefix = namespaces.normalize(prefix)
+	if trailingSpace && prefix != "" && !strings.HasSuffix(prefix, ":") {
+		prefix += " "
+	}
+	if filter {
+		// "Template:Box" is already in the Template namespace.
+		if id, _ := namespaces.split(prefix); id != ns {
+			prefix = namespaces.prefix(ns) + prefix
+		}
+	}
+	return wk.titles().prefixSearch(prefix, ns, filter, limit), nil
+}
+
+// handleSuggest serves /api/suggest?prefix= with the matching titles.
+func (wk *wiki) handleSuggest(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	prefix := r.FormValue("prefix")
+	titles, err := wk.suggest(r, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if titles == nil {
+		titles = []string{}
+	}
+	return struct {
+		Prefix string   `json:"prefix"`
+		Titles []string `json:"titles"`
+	}{
+		Prefix: prefix,
+		Titles: titles,
+	}, nil
+}
+
+// handleOpenSearch serves /api/opensearch?search= in the OpenSearch
+// suggestions format used by browsers.
+func (wk *wiki) handleOpenSearch(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	query := r.FormValue("search")
+	titles, err := wk.suggest(r, query)
+	if err != nil {
+		return nil, err
+	}
+	descriptions := make([]string, len(titles))
+	urls := make([]string, len(titles))
+	for i, title := range titles {
+		urls[i] = baseURL(r) + wk.articleURL(title)
+	}
+	if titles == nil {
+		titles = []string{}
+	}
+	w.Header().Set("Content-Type", "application/x-suggestions+json")
+	return []interface{}{query, titles, descriptions, urls}, nil
+}
+
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// handleOpenSearchDescription serves the OpenSearch description that lets
+// browsers add wikigopher as a search engine.
+func (wk *wiki) handleOpenSearchDescription(w http.ResponseWriter, r *http.Request) error {
+	name := "wikigopher"
+	if wk.name != "" {
+		name += " " + wk.name
+	}
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	_, err := fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<OpenSearchDescription xmlns="http://a9.com/-/spec/opensearch/1.1/">
+  <ShortName>%[2]s</ShortName>
+  <Description>Search %[2]s</Description>
+  <InputEncoding>UTF-8</InputEncoding>
+  <Image height="16" width="16" type="image/png">%[1]s/static/favicon.png</Image>
+  <Url type="text/html" method="get" template="%[1]s%[3]s/search?q={searchTerms}"/>
+  <Url type="application/x-suggestions+json" method="get" template="%[1]s%[3]s/api/opensearch?search={searchTerms}"/>
+</OpenSearchDescription>
+`, html.EscapeString(baseURL(r)), html.EscapeString(name), html.EscapeString(wk.base()))
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestPrefixSearch(t *testing.T) {
+	idx := testTitleIndex(t,
+		[]string{
+			"Cat",
+			"Category:Cats",
+			"Category:Dogs",
+			"Catfish",
+			"Dog",
+			"Template:Cat",
+			"Template:Cite web",
+		},
+		[]indexEntry{
+			{ns: nsMain},
+			{ns: nsCategory},
+			{ns: nsCategory},
+			{ns: nsMain},
+			{ns: nsMain},
+			{ns: nsTemplate},
+			{ns: nsTemplate},
+		},
+	)
+
+	cases := []struct {
+		prefix string
+		ns     int
+		filter bool
+		limit  int
+		want   []string
+	}{
+		{"Cat", 0, false, 10, []string{"Cat", "Category:Cats", "Category:Dogs", "Catfish"}},
+		{"Cat", 0, false, 2, []string{"Cat", "Category:Cats"}},
+		{"Cat", 0, true, 10, []string{"Cat", "Catfish"}},
+		{"Template:C", 10, true, 10, []string{"Template:Cat", "Template:Cite web"}},
+		{"Category:D", 14, true, 10, []string{"Category:Dogs"}},
+		{"Zebra", 0, false, 10, nil},
+	}
+	for _, c := range cases {
+		got := idx.prefixSearch(c.prefix, c.ns, c.filter, c.limit)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("prefixSearch(%q, %d, %t, %d) = %q; not %q", c.prefix, c.ns, c.filter, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestSuggestNamespacePrefix(t *testing.T) {
+	wk, dir := writeTestDump(t,
+		testPage(1, "Box", "Text"),
+		testPage(2, "Template:Box", "Text"),
+		testPage(3, "Template:Boxes", "Text"),
+	)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"namespace=Template&prefix=Box", []string{"Template:Box", "Template:Boxes"}},
+		{"namespace=Template&prefix=Template:Box", []string{"Template:Box", "Template:Boxes"}},
+		{"namespace=10&prefix=template:boxe", []string{"Template:Boxes"}},
+		{"namespace=0&prefix=Template:Box", nil},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/api/suggest?"+c.query, nil)
+		got, err := wk.suggest(r, r.FormValue("prefix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %q; not %q", c.query, got, c.want)
+		}
+	}
+}
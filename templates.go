@@ -13,8 +13,8 @@ import (
 	"github.com/pkg/errors"
 )
 
-var templateFuncs = map[string]func(attrs []wikitext.Attribute) (interface{}, error){
-	"ifeq": func(attrs []wikitext.Attribute) (interface{}, error) {
+var templateFuncs = map[string]func(wk *wiki, attrs []wikitext.Attribute) (interface{}, error){
+	"ifeq": func(wk *wiki, attrs []wikitext.Attribute) (interface{}, error) {
 		if len(attrs) < 3 || len(attrs) > 4 {
 			return nil, errors.Errorf("must have 3 or 4 arguments to #ifeq, got %d", len(attrs))
 		}
@@ -47,7 +47,7 @@ var templateFuncs = map[string]func(attrs []wikitext.Attribute) (interface{}, er
 		return falseVal, nil
 	},
 
-	"if": func(attrs []wikitext.Attribute) (interface{}, error) {
+	"if": func(wk *wiki, attrs []wikitext.Attribute) (interface{}, error) {
 		if len(attrs) < 2 || len(attrs) > 3 {
 			return nil, errors.Errorf("must have 2 or 3 arguments to #if, got %d", len(attrs))
 		}
@@ -62,12 +62,12 @@ var templateFuncs = map[string]func(attrs []wikitext.Attribute) (interface{}, er
 		return nil, nil
 	},
 
-	"invoke": func(attrs []wikitext.Attribute) (interface{}, error) {
+	"invoke": func(wk *wiki, attrs []wikitext.Attribute) (interface{}, error) {
 		if len(attrs) < 1 {
 			return nil, errors.Errorf("must have at least one attribute")
 		}
 
-		module, err := loadModule(wikitext.Concat(attrs[0]))
+		module, err := wk.loadModule(wikitext.Concat(attrs[0]))
 		if err != nil {
 			return nil, err
 		}
@@ -97,8 +97,8 @@ var templateFuncs = map[string]func(attrs []wikitext.Attribute) (interface{}, er
 					return 0
 				}
 				return lua.MultipleReturns
-			} else if strings.HasPrefix(moduleName, "Module:") {
-				body, err := articleBody(moduleName)
+			} else if ns, _ := wk.namespaces().split(moduleName); ns == nsModule {
+				body, err := wk.articleBody(moduleName)
 				if err != nil {
 					lua.Errorf(l, errors.Wrapf(err, "loading module %q", moduleName).Error())
 				}
@@ -129,9 +129,8 @@ var templateFuncs = map[string]func(attrs []wikitext.Attribute) (interface{}, er
 	},
 }
 
-func loadModule(name string) (string, error) {
-	name = "Module:" + name
-	return articleBody(name)
+func (wk *wiki) loadModule(name string) (string, error) {
+	return wk.articleBody(wk.namespaces().prefix(nsModule) + name)
 }
 
 func stripComments(code string) (string, error) {
@@ -151,22 +150,22 @@ func stripComments(code string) (string, error) {
 	return b.String(), nil
 }
 
-func articleBody(name string) (string, error) {
-	articleMeta, err := fetchArticle(name)
+func (wk *wiki) articleBody(name string) (string, error) {
+	p, err := wk.fetchPage(name)
 	if err != nil {
 		return "", err
 	}
-	p, err := readArticle(articleMeta)
+	p, _, err = wk.followRedirects(p)
 	if err != nil {
 		return "", err
 	}
 	return p.Text, nil
 }
 
-func templateFuncHandler(name string, attrs []wikitext.Attribute) (interface{}, error) {
+func (wk *wiki) templateFuncHandler(name string, attrs []wikitext.Attribute) (interface{}, error) {
 	f, ok := templateFuncs[name]
 	if ok {
-		v, err := f(attrs)
+		v, err := f(wk, attrs)
 		if err != nil {
 			log.Printf("Error executing func %q: %+v", name, err)
 			return nil, err
@@ -176,19 +175,32 @@ func templateFuncHandler(name string, attrs []wikitext.Attribute) (interface{},
 	return nil, errors.Errorf("unknown func: %q, args: %v", name, attrs)
 }
 
-func (p page) templateHandler(name string, attrs []wikitext.Attribute) (interface{}, error) {
+// wikiPage is a page along with the wiki it belongs to.
+type wikiPage struct {
+	page
+	wk *wiki
+}
+
+func (p wikiPage) templateHandler(name string, attrs []wikitext.Attribute) (interface{}, error) {
 	if name == "NAMESPACE" {
-		parts := strings.Split(p.Title, ":")
-		if len(parts) > 1 {
-			return parts[0], nil
-		}
-		return nil, nil
+		return strings.TrimSuffix(p.wk.namespaces().prefix(p.NS), ":"), nil
+
+	} else if name == "NAMESPACENUMBER" {
+		return p.NS, nil
+
+	} else if name == "PAGENAME" {
+		_, pageName := p.wk.namespaces().split(p.Title)
+		return pageName, nil
+
+	} else if name == "FULLPAGENAME" {
+		return p.Title, nil
 
 	} else if name == "NUMBEROFARTICLES" {
-		mu.Lock()
-		defer mu.Unlock()
+		return p.wk.titles().len(), nil
 
-		return len(mu.offsets), nil
+	} else if strings.HasPrefix(name, "DEFAULTSORT") {
+		// The sort key is only used by the category index.
+		return nil, nil
 
 	} else if strings.HasPrefix(name, "#") {
 		parts := strings.SplitN(name, ":", 2)
@@ -197,11 +209,11 @@ func (p page) templateHandler(name string, attrs []wikitext.Attribute) (interfac
 				{Key: parts[1]},
 			}, attrs...)
 		}
-		return templateFuncHandler(parts[0][1:], attrs)
+		return p.wk.templateFuncHandler(parts[0][1:], attrs)
 	}
 
 	/*
-		templateBody, err := articleBody("Template:" + name)
+		templateBody, err := p.wk.articleBody(p.wk.namespaces().prefix(nsTemplate) + name)
 		if err != nil {
 			return nil, errors.Wrapf(err, "unknown template: %q, args: %v", name, attrs)
 		}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// isTitleSpace reports whether r is treated as a space in titles. MediaWiki
+// treats underscores and all Unicode spaces the same.
+func isTitleSpace(r rune) bool {
+	return r == '_' || unicode.IsSpace(r)
+}
+
+// isDirectionMark reports whether r is an invisible bidi control character
+// which MediaWiki strips from titles.
+func isDirectionMark(r rune) bool {
+	return r == '\u200e' || r == '\u200f' || (r >= '\u202a' && r <= '\u202e')
+}
+
+// normalize converts a title the way MediaWiki does before looking it up:
+// it is converted to NFC, underscores and runs of whitespace become a single
+// space, the namespace prefix is replaced by its local name and the first
+// letter of the title is uppercased unless the namespace is case sensitive.
+func (t *namespaceTable) normalize(title string) string {
+	title = collapseSpaces(norm.NFC.String(title))
+	title = strings.TrimPrefix(title, ":")
+	title = strings.TrimSpace(title)
+
+	ns := nsMain
+	if i := strings.IndexByte(title, ':'); i >= 0 {
+		if id, ok := t.lookup(strings.TrimSpace(title[:i])); ok && id != nsMain {
+			ns = id
+			title = strings.TrimSpace(title[i+1:])
+		}
+	}
+	if !t.caseSensitive[ns] {
+		title = ucfirst(title)
+	}
+	return t.prefix(ns) + title
+}
+
+// collapseSpaces replaces each run of spaces and underscores with a single
+// space and removes direction marks.
+func collapseSpaces(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if isDirectionMark(r) {
+			continue
+		}
+		if isTitleSpace(r) {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// ucfirst uppercases the first letter of s like MediaWiki does for titles.
+func ucfirst(s string) string {
+	r, n := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[n:]
+}
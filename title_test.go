@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestNormalizeTitle(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"Foo", "Foo"},
+		{"foo", "Foo"},
+		{"McDonald's", "McDonald's"},
+		{"iPhone", "IPhone"},
+		{"foo_bar", "Foo bar"},
+		{"  foo __  bar  ", "Foo bar"},
+		{"foo\u00a0bar", "Foo bar"},
+		{"\u00e9clair", "\u00c9clair"},
+		{"e\u0301clair", "\u00c9clair"},
+		{"template:cite web", "Template:Cite web"},
+		{"TEMPLATE : cite_web", "Template:Cite web"},
+		{"image:Foo.jpg", "File:Foo.jpg"},
+		{"category_talk:foo", "Category talk:Foo"},
+		{":Category:Foo", "Category:Foo"},
+		{"Foo: bar", "Foo: bar"},
+		{"\u200efoo\u200f", "Foo"},
+		{"special:random", "Special:Random"},
+	}
+	namespaces := newNamespaceTable(siteInfo{})
+	for _, c := range cases {
+		if got := namespaces.normalize(c.in); got != c.want {
+			t.Errorf("normalize(%q) = %q; not %q", c.in, got, c.want)
+		}
+	}
+}
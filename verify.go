@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha1"
+	"expvar"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var sha1Mismatches = expvar.NewInt("sha1Mismatches")
+
+// sha1Base36 returns the SHA-1 of text the way MediaWiki stores it in dumps:
+// in base 36, zero padded to 31 digits.
+func sha1Base36(text string) string {
+	sum := sha1.Sum([]byte(text))
+	s := new(big.Int).SetBytes(sum[:]).Text(36)
+	return strings.Repeat("0", 31-len(s)) + s
+}
+
+// verify checks the text of p against the SHA-1 in the dump. Pages without
+// one, such as those from older dumps, always pass.
+func (p page) verify() error {
+	if p.SHA1 == "" {
+		return nil
+	}
+	if sum := sha1Base36(p.Text); sum != p.SHA1 {
+		sha1Mismatches.Add(1)
+		return errors.Errorf("page %q (%d) is corrupt: its text has sha1 %s but the dump has %s", p.Title, p.ID, sum, p.SHA1)
+	}
+	return nil
+}
+
+// verifyDump reads every stream in the dump and checks every page in it. Each
+// corrupt page or unreadable stream is logged and an error is returned at the
+// end if there were any.
+func (wk *wiki) verifyDump(workers int) error {
+	streams := wk.titles().streams()
+	log.Printf("%s: verifying %d streams...", wk.articlesFile, len(streams))
+
+	var mu sync.Mutex
+	var read, pages, corrupt int
+	if err := wk.walkStreams(streams, workers, func(seek int, streamPages []page) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, p := range streamPages {
+			if err := p.verify(); err != nil {
+				log.Print(err)
+				corrupt++
+			}
+		}
+		pages += len(streamPages)
+		read++
+		if read%1000 == 0 {
+			log.Printf("Verified %d/%d streams", read, len(streams))
+		}
+		return nil
+	}, func(seek int) error {
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// walkStreams logs and skips the streams it can't read.
+	unreadable := len(streams) - read
+	log.Printf("%s: verified %d pages in %d streams", wk.articlesFile, pages, read)
+	if corrupt > 0 || unreadable > 0 {
+		return errors.Errorf("%s: %d corrupt pages and %d unreadable streams", wk.articlesFile, corrupt, unreadable)
+	}
+	return nil
+}
+
+// verifyCommand runs `wikigopher verify`, which checks every page of every
+// wiki against its SHA-1.
+func verifyCommand(args []string) error {
+	if len(args) > 0 {
+		return usageErrorf("verify takes no arguments")
+	}
+	var failed []string
+	for _, wk := range wikis {
+		if err := wk.loadTitles(); err != nil {
+			return err
+		}
+		if err := wk.verifyDump(*fullTextWorkers); err != nil {
+			log.Print(err)
+			failed = append(failed, wk.articlesFile)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("verification failed for %s", strings.Join(failed, ", "))
+	}
+	log.Printf("All pages verified")
+	return nil
+}
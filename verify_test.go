@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSHA1Base36(t *testing.T) {
+	// The sha1 of empty revisions in Wikimedia dumps.
+	if got, want := sha1Base36(""), "phoiac9h4m842xq45sp7s6u21eteeq1"; got != want {
+		t.Errorf("sha1Base36(\"\") = %q; not %q", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	withSHA1 := func(page, sha1 string) string {
+		return strings.Replace(page, "</revision>", fmt.Sprintf("  <sha1>%s</sha1>\n    </revision>", sha1), 1)
+	}
+	wk, dir := writeTestDump(t,
+		withSHA1(testPage(1, "Good", "Some text"), sha1Base36("Some text")),
+		withSHA1(testPage(2, "Corrupt", "Some text"), sha1Base36("Other text")),
+		testPage(3, "Unhashed", "Some text"),
+	)
+	defer os.RemoveAll(dir)
+
+	old := *verifySHA1
+	defer func() { *verifySHA1 = old }()
+	*verifySHA1 = true
+
+	mismatches := sha1Mismatches.Value()
+	for _, title := range []string{"Good", "Unhashed"} {
+		if _, err := wk.fetchPage(title); err != nil {
+			t.Errorf("reading %q: %+v", title, err)
+		}
+	}
+	// Pages are only checked when they're first read.
+	for i := 0; i < 2; i++ {
+		if _, err := wk.fetchPage("Corrupt"); err == nil || !strings.Contains(err.Error(), "corrupt") {
+			t.Errorf("reading a corrupt page got %v", err)
+		}
+	}
+	if got := sha1Mismatches.Value() - mismatches; got != 1 {
+		t.Errorf("sha1Mismatches went up by %d; not 1", got)
+	}
+
+	if err := wk.verifyDump(2); err == nil || !strings.Contains(err.Error(), "1 corrupt pages") {
+		t.Errorf("verifyDump got %v", err)
+	}
+}
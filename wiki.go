@@ -0,0 +1,332 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/blevesearch/bleve"
+	"github.com/d4l3k/wikigopher/wikitext"
+	"github.com/pkg/errors"
+)
+
+// wikis are the dumps being served.
+var wikis []*wiki
+
+// wiki is a single dump along with its indexes and caches. When several dumps
+// are served each is mounted under /<name>/.
+type wiki struct {
+	// name is the path prefix the wiki is served under or "" if it's the only
+	// wiki and is served at the root.
+	name string
+
+	indexFile, indexCacheFile, articlesFile, searchIndexFile string
+
+	format dumpFormat
+	cache  *streamCache
+	status loadState
+
+	// files are the dumps streams are read from, opened once and shared by
+	// every read through ReadAt.
+	filesMu sync.Mutex
+	files   map[string]*os.File
+
+	// current holds the *snapshot that requests read the indexes from.
+	current atomic.Value
+	// update serializes changes to the snapshot.
+	update sync.Mutex
+}
+
+// snapshot is an immutable view of a wiki's indexes. Loading or rebuilding an
+// index publishes a new snapshot rather than changing the current one, so
+// reading pages never takes a lock.
+type snapshot struct {
+	site       siteInfo
+	namespaces *namespaceTable
+	titles     *titleIndex
+	// index is the search index or nil if there isn't one.
+	index bleve.Index
+	// categories and backlinks are nil until their indexes are loaded.
+	categories *categoryIndex
+	backlinks  *backlinkIndex
+	// incremental are the dumps applied on top of the articles dump, in
+	// order. Stream offsets from the nth are stored shifted by
+	// incrementalShift.
+	incremental  []incrementalDump
+	deletionLogs []string
+}
+
+func newWiki(name, articlesFile, indexFile string) *wiki {
+	wk := &wiki{
+		name:         name,
+		articlesFile: articlesFile,
+		indexFile:    indexFile,
+	}
+	// An empty index can't be too big.
+	titles, _ := newTitleIndex(nil, nil)
+	wk.current.Store(&snapshot{
+		namespaces: newNamespaceTable(siteInfo{}),
+		titles:     titles,
+	})
+	return wk
+}
+
+var wikiNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedWikiName reports whether name is a top level path the server uses
+// itself, so a wiki served under it would clash with it.
+func reservedWikiName(name string) bool {
+	switch name {
+	// net/http/pprof and expvar register their handlers under /debug/.
+	case "api", "debug":
+		return true
+	}
+	for path := range rootHandlers {
+		if strings.TrimSuffix(path, "/") == "/"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWikiFlag parses the value of a -wiki flag, name=articles[,index]. If
+// the index isn't given for a multistream dump it's assumed to be next to it
+// like on dumps.wikimedia.org.
+func parseWikiFlag(s string) (*wiki, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("expected name=articles[,index], got %q", s)
+	}
+	name := parts[0]
+	if !wikiNameRegexp.MatchString(name) || reservedWikiName(name) {
+		return nil, errors.Errorf("invalid wiki name %q", name)
+	}
+	files := strings.SplitN(parts[1], ",", 2)
+	articles := files[0]
+	var index string
+	if len(files) > 1 {
+		index = files[1]
+	} else if strings.HasSuffix(articles, ".xml.bz2") {
+		index = strings.TrimSuffix(articles, ".xml.bz2") + "-index.txt.bz2"
+	}
+	wk := newWiki(name, articles, index)
+	wk.searchIndexFile = filepath.Join(filepath.Dir(*searchIndexFile), name+"-"+filepath.Base(*searchIndexFile))
+	return wk, nil
+}
+
+// wikiFlag collects the repeatable -wiki flag.
+type wikiFlag []string
+
+func (f *wikiFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *wikiFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// base returns the path prefix the wiki is served under.
+func (wk *wiki) base() string {
+	if wk == nil || wk.name == "" {
+		return ""
+	}
+	return "/" + wk.name
+}
+
+// snapshot returns the current indexes. Code that reads several of them
+// should use a single snapshot so they're consistent.
+func (wk *wiki) snapshot() *snapshot {
+	return wk.current.Load().(*snapshot)
+}
+
+// updateSnapshot publishes a copy of the current snapshot changed by f.
+func (wk *wiki) updateSnapshot(f func(s *snapshot)) {
+	wk.update.Lock()
+	defer wk.update.Unlock()
+
+	s := *wk.snapshot()
+	f(&s)
+	wk.current.Store(&s)
+}
+
+func (wk *wiki) namespaces() *namespaceTable {
+	return wk.snapshot().namespaces
+}
+
+func (wk *wiki) siteInfo() siteInfo {
+	return wk.snapshot().site
+}
+
+func (wk *wiki) titles() *titleIndex {
+	return wk.snapshot().titles
+}
+
+func (wk *wiki) articleURL(title string) string {
+	return wk.base() + path.Join("/wiki/", wikitext.TitleToURL(title))
+}
+
+// mainPage returns the title of the wiki's main page from the dump's
+// siteinfo.
+func (wk *wiki) mainPage() string {
+	base := wk.siteInfo().Base
+	if i := strings.Index(base, "/wiki/"); i >= 0 && i+len("/wiki/") < len(base) {
+		return wikitext.URLToTitle(base[i+len("/wiki/"):])
+	}
+	return "Main Page"
+}
+
+// pageData is embedded in the data of every page for the layout in
+// base.html.
+type pageData struct {
+	// Base is the path prefix of the wiki the page belongs to.
+	Base     string
+	SiteName string
+	// MainPage is the URL of the wiki's main page or "" for pages that don't
+	// belong to a wiki.
+	MainPage string
+	// Static is set for pages written by the build command, which can't
+	// link to anything that needs the server like search or special pages.
+	Static bool
+}
+
+func (wk *wiki) pageData() pageData {
+	if wk == nil {
+		return pageData{}
+	}
+	return pageData{
+		Base:     wk.base(),
+		SiteName: wk.siteInfo().SiteName,
+		MainPage: wk.articleURL(wk.mainPage()),
+	}
+}
+
+// projectSuffixes are the suffixes of database names and the project they
+// belong to, e.g. enwiktionary is the English Wiktionary.
+var projectSuffixes = []struct {
+	suffix, project string
+}{
+	{"wiktionary", "wiktionary"},
+	{"wikibooks", "wikibooks"},
+	{"wikinews", "wikinews"},
+	{"wikiquote", "wikiquote"},
+	{"wikisource", "wikisource"},
+	{"wikiversity", "wikiversity"},
+	{"wikivoyage", "wikivoyage"},
+	{"wiki", "wikipedia"},
+}
+
+// projectPrefixes are the interwiki prefixes that link to the same language
+// edition of another project.
+var projectPrefixes = map[string]string{
+	"w":           "wikipedia",
+	"wikipedia":   "wikipedia",
+	"wikt":        "wiktionary",
+	"wiktionary":  "wiktionary",
+	"b":           "wikibooks",
+	"wikibooks":   "wikibooks",
+	"n":           "wikinews",
+	"wikinews":    "wikinews",
+	"q":           "wikiquote",
+	"wikiquote":   "wikiquote",
+	"s":           "wikisource",
+	"wikisource":  "wikisource",
+	"v":           "wikiversity",
+	"wikiversity": "wikiversity",
+	"voy":         "wikivoyage",
+	"wikivoyage":  "wikivoyage",
+}
+
+// project returns the language and project of the wiki from its database
+// name.
+func (wk *wiki) project() (lang, project string) {
+	dbName := wk.siteInfo().DBName
+	for _, p := range projectSuffixes {
+		if strings.HasSuffix(dbName, p.suffix) {
+			lang = strings.TrimSuffix(dbName, p.suffix)
+			return strings.Replace(lang, "_", "-", -1), p.project
+		}
+	}
+	return "", ""
+}
+
+// interwiki returns the loaded wiki that the interwiki prefix of title refers
+// to and the title on that wiki. Language prefixes like "de:" link to another
+// language of the same project and project prefixes like "wikt:" link to
+// another project in the same language.
+func (wk *wiki) interwiki(title string) (*wiki, string, bool) {
+	title = strings.TrimPrefix(title, ":")
+	i := strings.IndexByte(title, ':')
+	if i < 0 {
+		return nil, "", false
+	}
+	prefix := strings.ToLower(strings.TrimSpace(title[:i]))
+	if _, ok := wk.namespaces().lookup(prefix); ok {
+		return nil, "", false
+	}
+	lang, project := wk.project()
+	if p, ok := projectPrefixes[prefix]; ok {
+		project = p
+	} else {
+		lang = prefix
+	}
+	for _, other := range wikis {
+		if other == wk {
+			continue
+		}
+		if otherLang, otherProject := other.project(); otherLang == lang && otherProject == project {
+			return other, strings.TrimSpace(title[i+1:]), true
+		}
+	}
+	return nil, "", false
+}
+
+// handle registers the wiki's handlers under its path prefix.
+func (wk *wiki) handle(mux *http.ServeMux) {
+	base := wk.base()
+	mux.HandleFunc(base+"/source/", wk.errorHandler(wk.readyHandler(wk.handleSource)))
+	mux.HandleFunc(base+"/wiki/", wk.errorHandler(wk.readyHandler(wk.handleArticle)))
+	mux.HandleFunc(base+"/search", wk.errorHandler(wk.readyHandler(wk.handleSearch)))
+	mux.HandleFunc(base+"/api/suggest", wk.jsonHandler(wk.handleSuggest))
+	mux.HandleFunc(base+"/api/opensearch", wk.jsonHandler(wk.handleOpenSearch))
+	mux.HandleFunc(base+"/api/page/", wk.jsonHandler(wk.handlePage))
+	mux.HandleFunc(base+"/opensearch.xml", wk.errorHandler(wk.handleOpenSearchDescription))
+	mux.HandleFunc(base+"/", wk.errorHandler(wk.handleIndex))
+}
+
+type wikiListing struct {
+	Name, URL, SiteName, DBName string
+	Progress                    loadProgress
+}
+
+// handleWikis serves the landing page listing every wiki when more than one
+// is being served.
+func handleWikis(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path != "/" {
+		return statusErrorf(http.StatusNotFound, "no wiki at %q", r.URL.Path)
+	}
+	var listings []wikiListing
+	for _, wk := range wikis {
+		site := wk.siteInfo()
+		listings = append(listings, wikiListing{
+			Name:     wk.name,
+			URL:      wk.base() + "/",
+			SiteName: site.SiteName,
+			DBName:   site.DBName,
+			Progress: wk.status.progress(),
+		})
+	}
+	return executeTemplate(w, "index.html", struct {
+		pageData
+		Title string
+		Wikis []wikiListing
+	}{
+		Title: "Wikis",
+		Wikis: listings,
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestParseWikiFlag(t *testing.T) {
+	wk, err := parseWikiFlag("dewiki=dumps/dewiki-latest-pages-articles-multistream.xml.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wk.name != "dewiki" || wk.indexFile != "dumps/dewiki-latest-pages-articles-multistream-index.txt.bz2" {
+		t.Errorf("got name %q, index %q", wk.name, wk.indexFile)
+	}
+
+	wk, err = parseWikiFlag("dewiki=dewiki.xml.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wk.indexFile != "" {
+		t.Errorf("got index %q for a gzipped dump", wk.indexFile)
+	}
+
+	for _, s := range []string{
+		"dewiki", "de/wiki=a.xml.bz2", "static=a.xml.bz2", "api=a.xml.bz2",
+		"debug=a.xml.bz2", "healthz=a.xml.bz2", "readyz=a.xml.bz2",
+	} {
+		if _, err := parseWikiFlag(s); err == nil {
+			t.Errorf("parseWikiFlag(%q) should fail", s)
+		}
+	}
+}
+
+func TestInterwiki(t *testing.T) {
+	newTestWiki := func(name string) *wiki {
+		wk := newWiki(name, "", "")
+		wk.updateSnapshot(func(s *snapshot) {
+			s.site = siteInfo{DBName: name}
+		})
+		return wk
+	}
+	enwiki := newTestWiki("enwiki")
+	dewiki := newTestWiki("dewiki")
+	enwiktionary := newTestWiki("enwiktionary")
+
+	old := wikis
+	defer func() { wikis = old }()
+	wikis = []*wiki{enwiki, dewiki, enwiktionary}
+
+	cases := []struct {
+		from  *wiki
+		title string
+		want  *wiki
+		rest  string
+	}{
+		{enwiki, "de:Berlin", dewiki, "Berlin"},
+		{enwiki, ":de:Berlin", dewiki, "Berlin"},
+		{enwiki, "wikt:cat", enwiktionary, "cat"},
+		{enwiktionary, "w:Cat", enwiki, "Cat"},
+		{dewiki, "en:Berlin", enwiki, "Berlin"},
+		{enwiki, "fr:Paris", nil, ""},
+		{enwiki, "Category:Cats", nil, ""},
+		{enwiki, "Cats", nil, ""},
+	}
+	for _, c := range cases {
+		got, rest, _ := c.from.interwiki(c.title)
+		if got != c.want || rest != c.rest {
+			t.Errorf("%s.interwiki(%q) = %v, %q; not %v, %q", c.from.name, c.title, got, rest, c.want, c.rest)
+		}
+	}
+}
+
+func TestSwapTitleIndexWhileReading(t *testing.T) {
+	wk := newWiki("", "", "")
+	before := testTitleIndex(t, []string{"A"}, []indexEntry{{id: 1}})
+	after := testTitleIndex(t, []string{"A", "B"}, []indexEntry{{id: 1}, {id: 2}})
+	swap := func(idx *titleIndex) {
+		wk.updateSnapshot(func(s *snapshot) {
+			s.titles = idx
+		})
+	}
+	swap(before)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if entry, err := wk.fetchArticle("A"); err != nil || entry.id != 1 {
+					t.Errorf("fetchArticle(A) = %+v, %v", entry, err)
+					return
+				}
+			}
+		}()
+	}
+	swap(after)
+	wg.Wait()
+
+	if entry, err := wk.fetchArticle("B"); err != nil || entry.id != 2 {
+		t.Errorf("after swapping fetchArticle(B) = %+v, %v", entry, err)
+	}
+}
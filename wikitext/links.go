@@ -0,0 +1,207 @@
+package wikitext
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Link is a wikilink found in wikitext.
+type Link struct {
+	// Target is the page linked to, including any leading colon.
+	Target string
+	// Text is the text after the first pipe, or "" if there isn't one.
+	Text string
+}
+
+// Links returns every wikilink in text in order, including links nested in
+// file captions. Like PlainText it works on the source so links added by
+// templates aren't found.
+func Links(text []byte) []Link {
+	text = commentRegexp.ReplaceAll(text, nil)
+	return appendLinks(nil, text)
+}
+
+func appendLinks(links []Link, text []byte) []Link {
+	for {
+		_, link, rest, ok := nextWikilink(text)
+		if !ok {
+			return links
+		}
+		text = rest
+
+		l := Link{Target: strings.TrimSpace(string(link))}
+		var caption []byte
+		if i := bytes.IndexByte(link, '|'); i >= 0 {
+			l.Target = strings.TrimSpace(string(link[:i]))
+			l.Text = strings.TrimSpace(string(link[i+1:]))
+			caption = link[i+1:]
+		}
+		links = appendLinks(append(links, l), caption)
+	}
+}
+
+// Templates returns the names of the templates used in text in order,
+// including ones nested in the arguments of others. Parser functions like
+// {{#if:}}, magic words like {{PAGENAME}} and template parameters are left
+// out.
+func Templates(text []byte) []string {
+	text = commentRegexp.ReplaceAll(text, nil)
+	return appendTemplates(nil, text)
+}
+
+func appendTemplates(names []string, text []byte) []string {
+	for {
+		start := bytes.Index(text, []byte("{{"))
+		if start < 0 {
+			return names
+		}
+		text = text[start+2:]
+
+		// Find the matching }}, allowing for nested templates.
+		depth := 1
+		end := -1
+		for i := 0; i+1 < len(text); i++ {
+			if text[i] == '{' && text[i+1] == '{' {
+				depth++
+				i++
+			} else if text[i] == '}' && text[i+1] == '}' {
+				depth--
+				if depth == 0 {
+					end = i
+					break
+				}
+				i++
+			}
+		}
+		if end < 0 {
+			return names
+		}
+		inner := text[:end]
+		text = text[end+2:]
+
+		// {{{parameters}}} may have templates in their defaults.
+		if bytes.HasPrefix(inner, []byte("{")) {
+			names = appendTemplates(names, inner[1:])
+			continue
+		}
+		name := inner
+		if i := bytes.IndexByte(name, '|'); i >= 0 {
+			name = name[:i]
+		}
+		if s := strings.TrimSpace(string(name)); isTemplateName(s) {
+			names = append(names, s)
+		}
+		names = appendTemplates(names, inner)
+	}
+}
+
+// isTemplateName reports whether name refers to a template rather than a
+// parser function or magic word.
+func isTemplateName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "#") || strings.ContainsAny(name, "{}[]<>") {
+		return false
+	}
+	word := name
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		word = strings.TrimSpace(name[:i])
+		if parserFunctions[strings.ToLower(word)] {
+			return false
+		}
+	}
+	return !magicWords[word]
+}
+
+// parserFunctions are the parser functions without a # in front, like
+// {{lc:Foo}}. Like in MediaWiki their names are case insensitive.
+var parserFunctions = wordSet(`
+	lc lcfirst uc ucfirst urlencode anchorencode localurl localurle fullurl
+	fullurle canonicalurl canonicalurle filepath ns nse formatnum grammar
+	gender plural bidi int padleft padright special speciale formatdate
+	dateformat language noexternallanglinks
+`)
+
+// magicWords are the variables like {{PAGENAME}} and the case sensitive
+// parser functions like {{DEFAULTSORT:Foo}}. Templates with all upper case
+// names, like {{NPOV}}, aren't magic.
+var magicWords = wordSet(`
+	! =
+	CURRENTYEAR CURRENTMONTH CURRENTMONTH1 CURRENTMONTH2 CURRENTMONTHNAME
+	CURRENTMONTHNAMEGEN CURRENTMONTHABBREV CURRENTDAY CURRENTDAY2 CURRENTDOW
+	CURRENTDAYNAME CURRENTTIME CURRENTHOUR CURRENTWEEK CURRENTTIMESTAMP
+	LOCALYEAR LOCALMONTH LOCALMONTH1 LOCALMONTH2 LOCALMONTHNAME
+	LOCALMONTHNAMEGEN LOCALMONTHABBREV LOCALDAY LOCALDAY2 LOCALDOW
+	LOCALDAYNAME LOCALTIME LOCALHOUR LOCALWEEK LOCALTIMESTAMP
+	SITENAME SERVER SERVERNAME SCRIPTPATH STYLEPATH CURRENTVERSION
+	CONTENTLANGUAGE CONTENTLANG PAGELANGUAGE DIRECTIONMARK DIRMARK
+	NUMBEROFPAGES NUMBEROFARTICLES NUMBEROFFILES NUMBEROFEDITS NUMBEROFUSERS
+	NUMBEROFACTIVEUSERS NUMBEROFADMINS NUMBERINGROUP NUMINGROUP
+	PAGESINCATEGORY PAGESINCAT PAGESINNAMESPACE PAGESINNS PAGESIZE
+	NAMESPACE NAMESPACEE NAMESPACENUMBER TALKSPACE TALKSPACEE SUBJECTSPACE
+	SUBJECTSPACEE ARTICLESPACE ARTICLESPACEE
+	FULLPAGENAME FULLPAGENAMEE PAGENAME PAGENAMEE BASEPAGENAME BASEPAGENAMEE
+	ROOTPAGENAME ROOTPAGENAMEE SUBPAGENAME SUBPAGENAMEE TALKPAGENAME
+	TALKPAGENAMEE SUBJECTPAGENAME SUBJECTPAGENAMEE ARTICLEPAGENAME
+	ARTICLEPAGENAMEE
+	PAGEID REVISIONID REVISIONDAY REVISIONDAY2 REVISIONMONTH REVISIONMONTH1
+	REVISIONYEAR REVISIONTIMESTAMP REVISIONUSER REVISIONSIZE
+	CASCADINGSOURCES PROTECTIONLEVEL PROTECTIONEXPIRY
+	DISPLAYTITLE DEFAULTSORT DEFAULTSORTKEY DEFAULTCATEGORYSORT
+`)
+
+func wordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+var invokeRegexp = regexp.MustCompile(`\{\{\s*#invoke\s*:([^|}]*)`)
+
+// Modules returns the names of the Lua modules called with {{#invoke:}} in
+// text, without the Module: prefix.
+func Modules(text []byte) []string {
+	text = commentRegexp.ReplaceAll(text, nil)
+	var names []string
+	for _, m := range invokeRegexp.FindAllSubmatch(text, -1) {
+		if name := strings.TrimSpace(string(m[1])); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+var defaultSortRegexp = regexp.MustCompile(`\{\{\s*DEFAULT(?:SORT|SORTKEY|CATEGORYSORT)\s*:([^|}]*)`)
+
+// DefaultSort returns the sort key set with {{DEFAULTSORT:...}} or "" if
+// there isn't one. Like MediaWiki the last one wins.
+func DefaultSort(text []byte) string {
+	text = commentRegexp.ReplaceAll(text, nil)
+	m := defaultSortRegexp.FindAllSubmatch(text, -1)
+	if len(m) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(string(m[len(m)-1][1]))
+}
+
+// filterLinks removes the wikilinks under n that keep returns false for.
+func filterLinks(n *html.Node, keep func(target string) bool) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && c.Data == "a" {
+			for _, attr := range c.Attr {
+				if attr.Key == "href" && strings.HasPrefix(attr.Val, "./") && !keep(URLToTitle(attr.Val[2:])) {
+					n.RemoveChild(c)
+					break
+				}
+			}
+		}
+		if c.Parent == n {
+			filterLinks(c, keep)
+		}
+		c = next
+	}
+}
@@ -0,0 +1,92 @@
+package wikitext
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLinks(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []Link
+	}{
+		{"No links", nil},
+		{"A [[Link]] and [[ Target | label ]].", []Link{{"Link", ""}, {"Target", "label"}}},
+		{"[[File:Foo.jpg|thumb|A [[caption]]]]", []Link{{"File:Foo.jpg", "thumb|A [[caption]]"}, {"caption", ""}}},
+		{"[[Category:Foo|Bar]][[:Category:Baz]]", []Link{{"Category:Foo", "Bar"}, {":Category:Baz", ""}}},
+		{"<!-- [[Hidden]] -->[[Unclosed", nil},
+	}
+	for _, c := range cases {
+		if got := Links([]byte(c.in)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Links(%q) = %q; not %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestModules(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"{{Template}}", nil},
+		{"{{#invoke:Citation/CS1|citation}} {{ #invoke: Infobox |infobox}}", []string{"Citation/CS1", "Infobox"}},
+		{"{{Foo|{{#invoke:Nested|f}}}}<!-- {{#invoke:Hidden|f}} -->", []string{"Nested"}},
+	}
+	for _, c := range cases {
+		if got := Modules([]byte(c.in)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Modules(%q) = %q; not %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestDefaultSort(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"No sort key", ""},
+		{"{{DEFAULTSORT:Smith, John}}", "Smith, John"},
+		{"{{DEFAULTSORT:A}} {{ DEFAULTSORTKEY: B |noerror}}", "B"},
+	}
+	for _, c := range cases {
+		if got := DefaultSort([]byte(c.in)); got != c.want {
+			t.Errorf("DefaultSort(%q) = %q; not %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestLinkFilter(t *testing.T) {
+	out, err := Convert(
+		[]byte("A [[Foo]] and [[Category:Bar]]."),
+		LinkFilter(func(target string) bool {
+			return !strings.HasPrefix(target, "Category:")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out); !strings.Contains(got, "./Foo") || strings.Contains(got, "Category") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"No templates", nil},
+		{"{{Infobox person|name={{nowrap|A B}}}} {{ cite web |url=x}}", []string{"Infobox person", "nowrap", "cite web"}},
+		{"{{#if:{{{1|}}}|{{Yes}}}} {{PAGENAME}} {{DEFAULTSORT:Foo}} {{{2|{{Default}}}}}", []string{"Yes", "Default"}},
+		{"{{Template:Foo}} {{:Main Page}}", []string{"Template:Foo", ":Main Page"}},
+		// All caps templates aren't magic words.
+		{"{{NPOV}} {{IPA|/a/}} {{ISBN|123}} {{USA}}", []string{"NPOV", "IPA", "ISBN", "USA"}},
+		{"{{CURRENTYEAR}} {{PAGENAME:Foo}} {{!}} {{lc:Foo}} {{UC:foo}} {{ns:0}} {{DISPLAYTITLE:x}}", nil},
+		{"<!-- {{Hidden}} -->{{Unclosed", nil},
+	}
+	for _, c := range cases {
+		if got := Templates([]byte(c.in)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Templates(%q) = %q; not %q", c.in, got, c.want)
+		}
+	}
+}
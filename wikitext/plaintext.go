@@ -0,0 +1,128 @@
+package wikitext
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	commentRegexp   = regexp.MustCompile(`(?s)<!--.*?-->`)
+	refRegexp       = regexp.MustCompile(`(?is)<ref[^>]*/>|<ref[^>]*>.*?</ref>`)
+	tagRegexp       = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	extLinkRegexp   = regexp.MustCompile(`\[(?:https?:)?//[^\s\]]+\s*([^\]]*)\]`)
+	headingRegexp   = regexp.MustCompile(`(?m)^=+\s*(.*?)\s*=+\s*$`)
+	emphasisRegexp  = regexp.MustCompile(`'{2,}`)
+	whitespaceRegex = regexp.MustCompile(`\s+`)
+)
+
+// droppedLinkPrefixes are wikilink namespaces whose links don't contribute any
+// text to the article.
+var droppedLinkPrefixes = []string{"file:", "image:", "category:", "media:"}
+
+// PlainText strips the markup from wikitext and returns the readable text. It
+// is much cheaper than Convert and doesn't expand templates, which are removed
+// along with tables, references and comments.
+func PlainText(text []byte) string {
+	text = commentRegexp.ReplaceAll(text, nil)
+	text = refRegexp.ReplaceAll(text, nil)
+	text = removeNested(text, "{{", "}}")
+	text = removeNested(text, "{|", "|}")
+	text = replaceWikilinks(text)
+	text = extLinkRegexp.ReplaceAll(text, []byte("$1"))
+	text = tagRegexp.ReplaceAll(text, nil)
+	text = headingRegexp.ReplaceAll(text, []byte("$1"))
+	text = emphasisRegexp.ReplaceAll(text, nil)
+	out := html.UnescapeString(string(text))
+	return strings.TrimSpace(whitespaceRegex.ReplaceAllString(out, " "))
+}
+
+// removeNested removes every balanced open ... close span from text. An
+// unbalanced open removes the rest of the text.
+func removeNested(text []byte, open, close string) []byte {
+	var out []byte
+	depth := 0
+	for i := 0; i < len(text); {
+		if bytes.HasPrefix(text[i:], []byte(open)) {
+			depth++
+			i += len(open)
+		} else if depth > 0 && bytes.HasPrefix(text[i:], []byte(close)) {
+			depth--
+			i += len(close)
+		} else {
+			if depth == 0 {
+				out = append(out, text[i])
+			}
+			i++
+		}
+	}
+	return out
+}
+
+// replaceWikilinks replaces [[target|label]] with its label, or the target if
+// there isn't one. Links to files and categories are removed.
+func replaceWikilinks(text []byte) []byte {
+	var out []byte
+	for {
+		before, link, rest, ok := nextWikilink(text)
+		out = append(out, before...)
+		if !ok {
+			return out
+		}
+		text = rest
+
+		target := link
+		if i := bytes.IndexByte(link, '|'); i >= 0 {
+			target = link[:i]
+			link = link[i+1:]
+		} else {
+			link = bytes.TrimPrefix(link, []byte(":"))
+		}
+		if hasDroppedPrefix(target) {
+			continue
+		}
+		out = append(out, replaceWikilinks(link)...)
+	}
+}
+
+// nextWikilink finds the first [[...]] in text and returns the text before
+// it, the contents of the link and the text after it. If there are no more
+// complete links ok is false and before is the rest of the text without any
+// unclosed [[.
+func nextWikilink(text []byte) (before, link, rest []byte, ok bool) {
+	start := bytes.Index(text, []byte("[["))
+	if start < 0 {
+		return text, nil, nil, false
+	}
+	before = text[:start]
+	text = text[start+2:]
+
+	// Find the matching ]], allowing for links nested in file captions.
+	depth := 1
+	for i := 0; i+1 < len(text); i++ {
+		if text[i] == '[' && text[i+1] == '[' {
+			depth++
+			i++
+		} else if text[i] == ']' && text[i+1] == ']' {
+			depth--
+			if depth == 0 {
+				return before, text[:i], text[i+2:], true
+			}
+			i++
+		}
+	}
+	return append(append([]byte(nil), before...), text...), nil, nil, false
+}
+
+// hasDroppedPrefix reports whether target is a file or category link. Links
+// starting with a colon such as [[:Category:Foo]] are displayed as normal.
+func hasDroppedPrefix(target []byte) bool {
+	target = bytes.ToLower(bytes.TrimSpace(target))
+	for _, prefix := range droppedLinkPrefixes {
+		if bytes.HasPrefix(target, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package wikitext
+
+import "testing"
+
+func TestPlainText(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"Blah", "Blah"},
+		{"== Test ==\nFoo", "Test Foo"},
+		{"'''Bold''' and ''italic''", "Bold and italic"},
+		{"{{Infobox|name={{nested|x}}}}Body", "Body"},
+		{"A [[Link]] and [[Target|label]].", "A Link and label."},
+		{"[[File:Foo.jpg|thumb|A [[caption]]]]Text", "Text"},
+		{"[[Category:Foo]][[:Category:Bar]]", "Category:Bar"},
+		{"See [http://example.com the site].", "See the site."},
+		{"Fact.<ref>Source</ref> More<ref name=\"a\" />.", "Fact. More."},
+		{"<!-- hidden -->Shown &amp; <b>bold</b>", "Shown & bold"},
+		{"{|\n| cell\n|}\nAfter", "After"},
+	}
+	for _, c := range cases {
+		if got := PlainText([]byte(c.in)); got != c.want {
+			t.Errorf("PlainText(%q) = %q; not %q", c.in, got, c.want)
+		}
+	}
+}
@@ -59,6 +59,9 @@ func Convert(text []byte, options ...ConvertOption) ([]byte, error) {
 		return nil, errors.Errorf("got %d extra children: doc %q, children %q", len(remaining), concat(doc), concat(remaining))
 	}
 	addChildren(doc, remaining)
+	if opts.linkFilter != nil {
+		filterLinks(doc, opts.linkFilter)
+	}
 
 	var buf bytes.Buffer
 	if err := html.Render(&buf, doc); err != nil {
@@ -98,6 +101,7 @@ func (a Attribute) String() string {
 
 type opts struct {
 	templateHandler func(name string, attrs []Attribute) (interface{}, error)
+	linkFilter      func(target string) bool
 	strict          bool
 }
 
@@ -112,6 +116,15 @@ func TemplateHandler(f func(name string, attrs []Attribute) (interface{}, error)
 	}
 }
 
+// LinkFilter sets a function that decides which wikilinks are kept. It's
+// called with the target of every link and links it returns false for are
+// removed from the output, e.g. category links which are shown separately.
+func LinkFilter(f func(target string) bool) ConvertOption {
+	return func(opts *opts) {
+		opts.linkFilter = f
+	}
+}
+
 func strict() ConvertOption {
 	return func(opts *opts) {
 		opts.strict = true